@@ -18,57 +18,229 @@ limitations under the License.
 */
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
-	"github.com/blevesearch/bleve"
-
 	"github.com/blevesearch/bleve/search/highlight/highlighter/ansi"
+	"github.com/blevesearch/bleve/search/highlight/highlighter/html"
 
 	"github.com/rspier/rt-static/data"
 )
 
 var (
-	dataPath  = flag.String("data", "/big/rt-static/out/", "path to json data")
+	dataPath  = flag.String("data", "/big/rt-static/out/", "path to json data; a list like updates:base.zip is searched in order")
 	indexPath = flag.String("index", filepath.Join(*dataPath, "index.bleve"), "path to bleve index")
+	// These match the search page's parameters, so a query can be checked
+	// here exactly as the web UI runs it.
+	order        = flag.String("order", "1", "1 for descending ticket ids, 0 for ascending, updated for most recently updated first")
+	statuses     = flag.String("status", "", "comma separated statuses to restrict the results to")
+	sortField    = flag.String("sort", "", "comma separated fields to sort by, -field for descending; overrides -order")
+	num          = flag.Int("num", 10, "number of results")
+	defaultQuery = flag.String("defaultquery", data.DefaultQuery, "query used for \"*\" searches")
+	highlight    = flag.String("highlight", "", "how to mark matches in subjects: ansi, html or none; ansi if stdout is a terminal, otherwise none")
 )
 
 func main() {
 	flag.Parse()
 
-	data, err := data.New(*dataPath, *indexPath)
-	defer data.Close()
+	style, err := highlightStyle(*highlight)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	q := "status:open"
-	if len(flag.Args()) > 0 {
-		q = strings.Join(flag.Args(), " ")
+	tix, err := data.New(*dataPath, *indexPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tix.Close()
+
+	args := flag.Args()
+	if len(args) > 0 {
+		switch args[0] {
+		case "fields":
+			if err := printFields(tix); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "verify":
+			ok, err := verify(tix)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if !ok {
+				tix.Close()
+				os.Exit(1)
+			}
+			return
+		case "search":
+			args = args[1:]
+		}
 	}
 
-	query := bleve.NewQueryStringQuery(q)
-	sr := bleve.NewSearchRequestOptions(query, 10, 0, false)
-	sr.Fields = []string{"id", "status", "subject"}
-	sr.Highlight = bleve.NewHighlightWithStyle(ansi.Name)
+	sts := splitList(*statuses)
 
-	sr.SortBy([]string{"-id"})
-	searchResults, err := data.Index.Search(sr)
+	q := strings.Join(args, " ")
+	if q == "" && len(sts) == 0 {
+		q = "status:open"
+	}
+	opts := data.NewTicketSearch(q, *order, sts, *defaultQuery)
+	opts.Size = *num
+	if *sortField != "" {
+		sb, bad := tix.SortBy(*sortField)
+		if len(bad) > 0 {
+			log.Printf("can't sort by %v; sortable fields: %v", strings.Join(bad, ", "), strings.Join(tix.SortableFields(), ", "))
+		}
+		if sb != nil {
+			opts.SortBy = sb
+		}
+	}
+	opts.Highlight = style
+	tickets, _, err := tix.Search(context.Background(), opts)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
 	// Sometimes the Fragment is empty.  Something to do with Unicode?
-	for _, d := range searchResults.Hits {
-		s := strings.Join(d.Fragments["subject"], "") // normally just one
+	for _, t := range tickets {
+		s := strings.Join(t.Fragments["subject"], "") // normally just one
 		if len(s) == 0 {
-			s = d.Fields["subject"].(string)
+			s = t.Subject
+		}
+		fmt.Printf("%s\t%s\t(%s)\n", t.ID, s, t.Status)
+	}
+}
+
+// splitList splits a comma separated flag value, trimming spaces around
+// the entries and dropping empty ones, as the server does.
+func splitList(s string) []string {
+	var l []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+// highlightStyle returns the bleve highlighter for the -highlight flag,
+// "" for none.
+func highlightStyle(name string) (string, error) {
+	switch name {
+	case "":
+		if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			return ansi.Name, nil
+		}
+		return "", nil
+	case ansi.Name, html.Name:
+		return name, nil
+	case "none":
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown -highlight %q, want ansi, html or none", name)
+}
+
+// printFields lists the fields in the bleve index, with their types from
+// the index mapping.  Fields the mapping doesn't mention were indexed
+// dynamically.
+func printFields(tix *data.Data) error {
+	fields, err := tix.Index.Fields()
+	if err != nil {
+		return err
+	}
+	types := tix.FieldTypes()
+	types["_all"] = "composite"
+	sort.Strings(fields)
+	for _, f := range fields {
+		t := types[f]
+		if t == "" {
+			t = "dynamic"
 		}
-		fmt.Printf("%.0f\t%s\t(%s)\n", d.Fields["id"], s, d.Fields["status"])
+		fmt.Printf("%s\t%s\n", f, t)
+	}
+	return nil
+}
+
+// verify fetches every ticket in index.json or the bleve index, and
+// compares those with each other and the tickets in the data files,
+// printing a line for each problem and then a summary.  It reports
+// whether there were no problems.
+func verify(tix *data.Data) (bool, error) {
+	listed := tix.TicketIDs()
+	indexed, err := tix.IndexedIDs()
+	if err != nil {
+		return false, fmt.Errorf("reading bleve ids: %w", err)
+	}
+	files, err := tix.SourceTicketIDs()
+	if err != nil {
+		return false, fmt.Errorf("listing tickets: %w", err)
+	}
+	get := func(id string) error {
+		_, err := tix.GetTicket(id)
+		return err
+	}
+	c := checkTickets(os.Stdout, listed, indexed, files, tix.Merged, get)
+	fmt.Printf("%d tickets in index.json, %d in bleve, %d in the data: %d can't be fetched, %d missing from bleve, %d missing from index.json, %d not indexed\n",
+		len(listed), len(indexed), len(files), c.failed, c.notBleve, c.notJSON, c.notIndexed)
+	return c == verifyCounts{}, nil
+}
+
+// verifyCounts counts the problems of each kind checkTickets finds.
+type verifyCounts struct {
+	failed     int // can't be fetched
+	notBleve   int // in index.json but not bleve
+	notJSON    int // in bleve but not index.json
+	notIndexed int // in the data but neither
+}
+
+// checkTickets compares the ticket ids in index.json (listed), the bleve
+// index and the data files, and fetches the indexed ones with get,
+// writing a line to w for each problem.  Tickets merged into others
+// aren't expected to be indexed.
+func checkTickets(w io.Writer, listed, indexed, files []string, merged map[string]string, get func(id string) error) verifyCounts {
+	inJSON := make(map[string]bool, len(listed))
+	for _, id := range listed {
+		inJSON[id] = true
+	}
+	inBleve := make(map[string]bool, len(indexed))
+	for _, id := range indexed {
+		inBleve[id] = true
 	}
 
+	var c verifyCounts
+	check := func(id string) {
+		if err := get(id); err != nil {
+			fmt.Fprintf(w, "%s\tcan't fetch: %v\n", id, err)
+			c.failed++
+		}
+	}
+	for _, id := range listed {
+		check(id)
+		if !inBleve[id] {
+			fmt.Fprintf(w, "%s\tin index.json but not bleve\n", id)
+			c.notBleve++
+		}
+	}
+	for _, id := range indexed {
+		if !inJSON[id] {
+			check(id)
+			fmt.Fprintf(w, "%s\tin bleve but not index.json\n", id)
+			c.notJSON++
+		}
+	}
+	for _, id := range files {
+		// Merged tickets redirect rather than being indexed themselves.
+		if _, isMerged := merged[id]; !inJSON[id] && !inBleve[id] && !isMerged {
+			fmt.Fprintf(w, "%s\tin the data but not indexed\n", id)
+			c.notIndexed++
+		}
+	}
+	return c
 }
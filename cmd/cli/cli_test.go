@@ -0,0 +1,61 @@
+package main
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheckTickets(t *testing.T) {
+	listed := []string{"1", "2", "3"}
+	indexed := []string{"1", "2", "4", "5"}
+	files := []string{"1", "2", "3", "4", "6", "7", "8"}
+	merged := map[string]string{"8": "1"}
+	get := func(id string) error {
+		switch id {
+		case "2", "5":
+			return errors.New("broken")
+		}
+		return nil
+	}
+	var out strings.Builder
+	got := checkTickets(&out, listed, indexed, files, merged, get)
+
+	want := verifyCounts{failed: 2, notBleve: 1, notJSON: 2, notIndexed: 2}
+	if got != want {
+		t.Errorf("checkTickets = %+v, want %+v", got, want)
+	}
+	wantLines := []string{
+		"2\tcan't fetch: broken",
+		"3\tin index.json but not bleve",
+		"4\tin bleve but not index.json",
+		"5\tcan't fetch: broken",
+		"5\tin bleve but not index.json",
+		"6\tin the data but not indexed",
+		"7\tin the data but not indexed",
+	}
+	if wantOut := strings.Join(wantLines, "\n") + "\n"; out.String() != wantOut {
+		t.Errorf("checkTickets wrote\n%v\nwant\n%v", out.String(), wantOut)
+	}
+
+	out.Reset()
+	if got := checkTickets(&out, listed, listed, listed, nil, func(string) error { return nil }); got != (verifyCounts{}) || out.Len() != 0 {
+		t.Errorf("checkTickets with no problems = %+v, wrote %q", got, out.String())
+	}
+}
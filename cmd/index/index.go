@@ -24,109 +24,293 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
-	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/index/scorch"
+	"github.com/blevesearch/bleve/index/store/boltdb"
+	"github.com/blevesearch/bleve/index/upsidedown"
 	"github.com/blevesearch/bleve/mapping"
 	"github.com/golang/glog"
+	"github.com/rspier/rt-static/data"
+	"github.com/rspier/rt-static/readers"
+	"github.com/rspier/rt-static/synonym"
+	"github.com/rspier/rt-static/version"
 	"github.com/schollz/progressbar/v2"
 	"golang.org/x/sync/semaphore"
 )
 
 var (
-	dataPath  = flag.String("data", "/big/rt-static/out/", "path to json data index")
+	dataPath  = flag.String("data", "/big/rt-static/out/", "directory, .zip or .tar.gz of json ticket data")
 	out       = flag.String("outdir", *dataPath, "path to write bleve data to")
 	bleveName = flag.String("blevename", "index.bleve", "name of bleve dir")
 	batchSize = flag.Int("batch", 1000, "bleve indexing batch size")
 	// In early testing (without a numeric field) batchSize=100 takes about a minute,
 	// batchSize=500 takes 26 seconds, batchSize=1000 takes 10 seconds.
-	parallelRead = flag.Int64("parallelread", 16, "number of ticket files to read at once")
+	parallelRead = flag.Int64("parallelread", defaultParallelRead(),
+		"number of ticket files to read at once. Parsing is CPU bound, but fast disks need several reads in flight to stay busy; too many thrashes small machines. Defaults to 2x CPUs, between 4 and 64")
+	stats       = flag.Bool("stats", false, "write index-stats.json alongside the outputs")
+	showVersion = flag.Bool("version", false, "print the version and exit")
+	validate    = flag.Bool("validate", false, "fail without writing outputs if any ticket fails validation")
+	synonyms    = flag.String("synonyms", "", "file of \"canonical, variant...\" lines to fold together at index time")
+	latin1      = flag.Bool("latin1", false, "read ticket files that aren't valid UTF-8 as ISO-8859-1")
+	indexType   = flag.String("indextype", upsidedown.Name, "bleve index type: upside_down (in a boltdb file) or scorch (segments, smaller and faster to build)")
+	// Attachment text makes the index several times bigger, so it's off
+	// by default and bounded when on.
+	indexAttachments    = flag.Bool("attachments", false, "index the text of text/* attachments (patches, logs) as attachment_content")
+	maxAttachmentText   = flag.Int("maxattachmenttext", 64<<10, "with -attachments, bytes of each attachment to index; the rest is ignored")
+	maxTicketAttachText = flag.Int("maxticketattachmenttext", 1<<20, "with -attachments, total bytes of attachment text to index per ticket")
 )
 
+// defaultParallelRead picks a -parallelread for this machine.
+func defaultParallelRead() int64 {
+	n := int64(2 * runtime.NumCPU())
+	if n < 4 {
+		return 4
+	}
+	if n > 64 {
+		return 64
+	}
+	return n
+}
+
 // ticket represents the fields of a ticket we're interested in for indexing
 
 type ticket struct {
-	ID           string `json:"Id"`
-	Status       string
-	Subject      string
+	ID      string `json:"Id"`
+	id      int    // ID as a number, for sorting and the bleve id field
+	updated int64  // last updated, as Unix seconds; 0 if unknown
+	// attachmentText is the text of the ticket's text attachments, with
+	// -attachments.  It's only needed for bleve, not index.json.
+	attachmentText string
+	numericID      bool // whether ID is a number; the ticket isn't indexed if not
+	Status         string
+	Subject        string
+	Transactions   []transaction
+}
+
+type transaction struct {
+	ID          string `json:"Id"`
+	Attachments []struct {
+		ID string `json:"Id"`
+	}
+}
+
+// ticketFile is a ticket as it's read, with the dates needed to work out
+// when it was last updated.  They aren't kept, so they don't end up in
+// index.json.
+type ticketFile struct {
+	ticket
+	Created      string
+	Transactions []struct {
+		transaction
+		Created string
+	}
+}
+
+// lastUpdated returns the latest transaction date of f, or its creation
+// date if it has no dated transactions, as Unix seconds.  It returns 0 if
+// there's no usable date at all.
+func lastUpdated(f *ticketFile) int64 {
+	var max int64
+	for _, tr := range f.Transactions {
+		if t, err := time.Parse(data.TimeLayout, tr.Created); err == nil && t.Unix() > max {
+			max = t.Unix()
+		}
+	}
+	if max == 0 {
+		if t, err := time.Parse(data.TimeLayout, f.Created); err == nil {
+			max = t.Unix()
+		}
+	}
+	return max
+}
+
+// attachmentsFile is the attachment content of a ticket file, read
+// separately so it's only decoded with -attachments.
+type attachmentsFile struct {
 	Transactions []struct {
-		ID          string `json:"Id"`
 		Attachments []struct {
-			ID string `json:"Id"`
+			Filename        string
+			ContentType     string
+			OriginalContent string
 		}
 	}
 }
 
-func processFile(path string) (*ticket, error) {
-	b, err := ioutil.ReadFile(path)
+// attachmentText returns the content of the named text/* attachments in
+// b, each cut to maxEach bytes and all of them to maxTotal.  Message
+// bodies have no filename and aren't included.  Only text attachments are
+// stored unencoded, so anything else would need decoding and may not be
+// text at all.
+func attachmentText(b []byte, maxEach, maxTotal int) (string, error) {
+	var f attachmentsFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for _, tr := range f.Transactions {
+		for _, a := range tr.Attachments {
+			if a.Filename == "" || !strings.HasPrefix(a.ContentType, "text/") {
+				continue
+			}
+			c := truncate(a.OriginalContent, maxEach)
+			c = truncate(c, maxTotal-sb.Len())
+			if c == "" {
+				continue
+			}
+			sb.WriteString(c)
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String(), nil
+}
+
+// truncate cuts s to at most n bytes, without splitting a character.
+func truncate(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func processFile(read func() ([]byte, error)) (*ticket, error) {
+	b, err := read()
 	if err != nil {
 		return nil, err
 	}
-	var t ticket
-	err = json.Unmarshal(b, &t)
+	b = readers.CleanJSON(b)
+	var f ticketFile
+	err = json.Unmarshal(b, &f)
 	if err != nil {
 		return nil, err
 	}
+	t := f.ticket
+	t.Transactions = make([]transaction, len(f.Transactions))
+	for i, tr := range f.Transactions {
+		t.Transactions[i] = tr.transaction
+	}
+	t.updated = lastUpdated(&f)
+	if *indexAttachments {
+		t.attachmentText, err = attachmentText(b, *maxAttachmentText, *maxTicketAttachText)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Everything downstream (sorting, range searches, the server's
+	// formatting of search results) assumes numeric ids.  Tickets without
+	// one are reported by validateTicket and left out.
+	t.id, t.numericID = numericID(t.ID)
 	return &t, nil
 }
 
-func readTickets(root string) []ticket {
+// numericID returns id as a number, and whether it is one.  Only plain
+// positive decimal numbers count, as "012" or "+12" wouldn't round trip.
+func numericID(id string) (int, bool) {
+	n, err := strconv.Atoi(id)
+	if err != nil || n <= 0 || strconv.Itoa(n) != id {
+		return 0, false
+	}
+	return n, true
+}
+
+// validateTicket returns the problems found with a ticket.  Apart from a
+// non-numeric id, which keeps it out of the index, these don't stop it
+// from being indexed, but likely mean the export is broken.
+func validateTicket(t *ticket) []string {
+	var problems []string
+	if !t.numericID {
+		problems = append(problems, fmt.Sprintf("ticket id %q is not numeric, not indexed", t.ID))
+	}
+	if t.Status == "" {
+		problems = append(problems, "empty status")
+	}
+	for i, tr := range t.Transactions {
+		if tr.ID == "" {
+			problems = append(problems, fmt.Sprintf("transaction %d has no id", i))
+		}
+	}
+	return problems
+}
+
+// readTickets returns the tickets under root, sorted by id, and the
+// problems found validating them.
+func readTickets(root string) ([]ticket, []string) {
 	var tickets []ticket
+	var problems []string
 
-	// Consider using the reader interfaces instead of reimplementing the parsing.
-	files, err := filepath.Glob(filepath.Join(root, "*.json"))
+	src, err := openTicketSource(root)
 	if err != nil {
 		log.Fatal(err)
 	}
-	bar := progressbar.NewOptions(len(files), progressbar.OptionSetDescription("reading tickets"))
+	defer src.close()
+
+	bar := progressbar.NewOptions(src.count, progressbar.OptionSetDescription("reading tickets"))
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 	sem := semaphore.NewWeighted(*parallelRead)
 
-	var fileRe = regexp.MustCompile(`\d+\.json$`)
-
-	for _, path := range files {
+	err = src.walk(func(path string, read func() ([]byte, error)) {
 		wg.Add(1)
 		_ = sem.Acquire(context.Background(), 1)
-		go func(path string) {
+		go func() {
 			defer wg.Done()
 			defer sem.Release(1)
-			if !fileRe.MatchString(path) {
-				return
-			}
 
-			t, err := processFile(path)
+			t, err := processFile(read)
 			if err != nil {
 				log.Fatalf("%v: %v", path, err)
 			}
 
 			bar.Add(1)
 
+			p := validateTicket(t)
+
 			mu.Lock()
-			tickets = append(tickets, *t)
+			if t.numericID {
+				tickets = append(tickets, *t)
+			}
+			if len(p) > 0 {
+				problems = append(problems, fmt.Sprintf("%v: %v", path, strings.Join(p, ", ")))
+			}
 			mu.Unlock()
 
-		}(path)
+		}()
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 	wg.Wait()
 
 	sort.Slice(tickets, func(i, j int) bool {
-		ii, _ := strconv.Atoi(tickets[i].ID)
-		jj, _ := strconv.Atoi(tickets[j].ID)
-		return ii < jj
+		return tickets[i].id < tickets[j].id
 	})
 
 	bar.Finish()
 	bar.Clear()
+	glog.Infof("read %d tickets from %v", len(tickets), root)
+	sort.Strings(problems)
 
-	return tickets
+	return tickets, problems
 }
 
-func setupTicketMapping(m *mapping.IndexMappingImpl) {
+// setupTicketMapping maps the ticket fields.  The server warns at startup
+// if the fields it needs from here are missing (see data.checkMapping).
+func setupTicketMapping(m *mapping.IndexMappingImpl, analyzer string) {
 	ticketMapping := bleve.NewDocumentMapping()
 	m.AddDocumentMapping("ticket", ticketMapping)
 
@@ -134,13 +318,26 @@ func setupTicketMapping(m *mapping.IndexMappingImpl) {
 	idFieldMapping := bleve.NewNumericFieldMapping()
 	ticketMapping.AddFieldMappingsAt("id", idFieldMapping)
 	subjectFieldMapping := bleve.NewTextFieldMapping()
-	subjectFieldMapping.Analyzer = "en"
+	subjectFieldMapping.Analyzer = analyzer
 	subjectFieldMapping.IncludeTermVectors = true
 	subjectFieldMapping.Store = true
 	ticketMapping.AddFieldMappingsAt("subject", subjectFieldMapping)
 	statusFieldMapping := bleve.NewTextFieldMapping()
-	statusFieldMapping.Analyzer = "en"
+	statusFieldMapping.Analyzer = analyzer
 	ticketMapping.AddFieldMappingsAt("status", statusFieldMapping)
+	// Unix seconds, for order=updated and range searches.  Stored so
+	// results can show it.
+	updatedFieldMapping := bleve.NewNumericFieldMapping()
+	updatedFieldMapping.Store = true
+	ticketMapping.AddFieldMappingsAt("updated", updatedFieldMapping)
+	// Only present with -attachments.  Neither stored nor given term
+	// vectors, which would copy the text into the index again; it's
+	// included in _all, so plain searches match it.
+	attachmentFieldMapping := bleve.NewTextFieldMapping()
+	attachmentFieldMapping.Analyzer = analyzer
+	attachmentFieldMapping.Store = false
+	attachmentFieldMapping.IncludeTermVectors = false
+	ticketMapping.AddFieldMappingsAt("attachment_content", attachmentFieldMapping)
 }
 
 /*
@@ -162,18 +359,54 @@ type indexedTicket struct {
 	ID      int    `json:"id"`
 	Status  string `json:"status"`
 	Subject string `json:"subject"`
+	// Updated is left out for tickets without a date, which sort last.
+	Updated           int64  `json:"updated,omitempty"`
+	AttachmentContent string `json:"attachment_content,omitempty"`
 }
 
 func (indexedTicket) BleveType() string {
 	return "ticket"
 }
 
-func buildBleveIndex(tickets []ticket, out string) error {
+// kvStore returns the bleve KV store to build an index of indexType with.
+// upside_down keeps everything in a KV store, bleve's default boltdb;
+// scorch manages its own segment files and ignores it.
+func kvStore(indexType string) (string, error) {
+	switch indexType {
+	case upsidedown.Name:
+		return boltdb.Name, nil
+	case scorch.Name:
+		return scorch.Name, nil
+	}
+	return "", fmt.Errorf("unknown index type %q, want %v or %v", indexType, upsidedown.Name, scorch.Name)
+}
+
+// buildBleveIndex writes the search index, of type indexType.  If syn is
+// non-empty, text fields use an analyzer that folds the variant spellings
+// in it.
+func buildBleveIndex(tickets []ticket, out, indexType string, batchSize int, syn map[string]string) error {
+	if batchSize < 1 {
+		return fmt.Errorf("batch size must be positive, got %d", batchSize)
+	}
+	kv, err := kvStore(indexType)
+	if err != nil {
+		return err
+	}
 	m := bleve.NewIndexMapping()
-	setupTicketMapping(m)
+	analyzer := "en"
+	if len(syn) > 0 {
+		if err := synonym.AddAnalyzer(m, syn); err != nil {
+			return err
+		}
+		analyzer = synonym.AnalyzerName
+		// Unqualified queries search _all with the default analyzer, which
+		// has to fold the same variants.
+		m.DefaultAnalyzer = analyzer
+	}
+	setupTicketMapping(m, analyzer)
 	//setupMessageMapping(m)
 
-	index, err := bleve.New(out, m)
+	index, err := bleve.NewUsing(out, m, indexType, kv, nil)
 	if err != nil {
 		return err
 	}
@@ -182,28 +415,43 @@ func buildBleveIndex(tickets []ticket, out string) error {
 	pb := progressbar.NewOptions(len(tickets), progressbar.OptionSetDescription("building bleve"))
 
 	batch := index.NewBatch()
-	for i, tick := range tickets {
+	for _, tick := range tickets {
 		pb.Add(1)
 
-		id, err := strconv.Atoi(tick.ID)
-		if err != nil {
-			glog.Errorf("Atoi(%v) failed, skipping: %v", tick.ID, err)
-			continue
+		doc := indexedTicket{
+			tick.id, tick.Status, tick.Subject, tick.updated, tick.attachmentText,
 		}
-		data := indexedTicket{
-			id, tick.Status, tick.Subject,
+		err = batch.Index(tick.ID, doc)
+		if err != nil {
+			return err
 		}
-		batch.Index(tick.ID, data)
-		if i%*batchSize == 0 {
-			index.Batch(batch)
+		if batch.Size() >= batchSize {
+			err = index.Batch(batch)
+			if err != nil {
+				return err
+			}
 			batch.Reset()
 		}
 	}
-	index.Batch(batch) // index the final batch
+	if batch.Size() > 0 {
+		err = index.Batch(batch) // index the final batch
+		if err != nil {
+			return err
+		}
+	}
 
 	pb.Finish()
 	pb.Clear()
 
+	// Make sure nothing was dropped or indexed twice.
+	count, err := index.DocCount()
+	if err != nil {
+		return err
+	}
+	if count != uint64(len(tickets)) {
+		return fmt.Errorf("indexed %d documents, expected %d", count, len(tickets))
+	}
+
 	return nil
 }
 
@@ -212,30 +460,162 @@ func writeIndexJSON(tickets []ticket, fn string) error { // Consider replacing t
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(fn, b, 0700)
+	return writeFileAtomic(fn, b, 0700)
+}
+
+// writeFileAtomic writes fn via a temporary file in the same directory, so
+// readers see either the old contents or the complete new ones.
+func writeFileAtomic(fn string, b []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(fn), "."+filepath.Base(fn)+".tmp")
 	if err != nil {
 		return err
 	}
-	return nil
+	tmp := f.Name()
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// indexStats summarizes an index build, for monitoring.
+type indexStats struct {
+	Tickets         int            `json:"tickets"`
+	Statuses        map[string]int `json:"statuses"`
+	Problems        int            `json:"problems"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	BleveBytes      int64          `json:"bleve_bytes"`
+	BatchSize       int            `json:"batch_size"`
+	ParallelRead    int64          `json:"parallel_read"`
+	// AttachmentTextBytes is how much attachment text was indexed, with
+	// -attachments.
+	AttachmentTextBytes int64 `json:"attachment_text_bytes,omitempty"`
+}
+
+// dirSize returns the total size of the files under root.
+func dirSize(root string) (int64, error) {
+	var size int64
+	err := filepath.Walk(root, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func writeStats(tickets []ticket, problems []string, start time.Time, outBleve, fn string) error {
+	st := indexStats{
+		Tickets:         len(tickets),
+		Statuses:        make(map[string]int),
+		Problems:        len(problems),
+		DurationSeconds: time.Since(start).Seconds(),
+		BatchSize:       *batchSize,
+		ParallelRead:    *parallelRead,
+	}
+	for _, t := range tickets {
+		st.Statuses[t.Status]++
+		st.AttachmentTextBytes += int64(len(t.attachmentText))
+	}
+	var err error
+	st.BleveBytes, err = dirSize(outBleve)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fn, b, 0644)
 }
 
 func main() {
 	flag.Parse()
+	start := time.Now()
+	readers.Latin1Fallback = *latin1
+
+	if *showVersion {
+		fmt.Println(version.Get())
+		return
+	}
+	glog.Infof("index version %v", version.Get())
+	if _, err := kvStore(*indexType); err != nil {
+		log.Fatal(err) // before spending time reading tickets
+	}
 
-	tickets := readTickets(*dataPath)
+	tickets, problems := readTickets(*dataPath)
+	if len(problems) > 0 {
+		fmt.Printf("%d tickets with problems:\n", len(problems))
+		for _, p := range problems {
+			fmt.Printf(" %s\n", p)
+		}
+		if *validate {
+			log.Fatalf("%d tickets failed validation", len(problems))
+		}
+	}
+
+	var syn map[string]string
+	if *synonyms != "" {
+		var err error
+		syn, err = synonym.Load(*synonyms)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("synonyms: %d variants\n", len(syn))
+	}
 
 	outIndex := filepath.Join(*out, "index.json")
 	outBleve := filepath.Join(*out, *bleveName)
 
 	fmt.Printf("outputs:\n %s\n %s\ntickets: %d\n", outIndex, outBleve, len(tickets))
 
+	// bleve won't overwrite an index, and the rename below can't either, so
+	// fail before doing any work.
+	if _, err := os.Stat(outBleve); err == nil {
+		log.Fatalf("%s already exists", outBleve)
+	}
+
 	err := writeIndexJSON(tickets, outIndex)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = buildBleveIndex(tickets, outBleve)
+	// Build the bleve index to the side and move it into place when it's
+	// complete, like index.json.
+	tmpBleve := outBleve + ".tmp"
+	err = os.RemoveAll(tmpBleve) // left over from an interrupted run
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = buildBleveIndex(tickets, tmpBleve, *indexType, *batchSize, syn)
 	if err != nil {
 		log.Fatal(err)
 	}
+	err = os.Rename(tmpBleve, outBleve)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *stats {
+		err = writeStats(tickets, problems, start, outBleve, filepath.Join(*out, "index-stats.json"))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 }
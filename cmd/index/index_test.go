@@ -0,0 +1,192 @@
+package main
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/index/upsidedown"
+)
+
+func TestNumericID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want int
+		ok   bool
+	}{
+		{"1", 1, true},
+		{"123456", 123456, true},
+		{"", 0, false},
+		{"0", 0, false},
+		{"012", 0, false},
+		{"+12", 0, false},
+		{"-12", 0, false},
+		{"12a", 0, false},
+		{"abc", 0, false},
+		{"RT-12", 0, false},
+	}
+	for _, tc := range tests {
+		got, ok := numericID(tc.id)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("numericID(%q) = %v, %v; want %v, %v", tc.id, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+// writeTickets writes a ticket file for each file name → ticket id.
+func writeTickets(t *testing.T, ids map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for fn, id := range ids {
+		b := []byte(fmt.Sprintf(`{"Id": %q, "Status": "open", "Subject": "ticket %s", "Transactions": []}`, id, id))
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestReadTicketsMixedIDs(t *testing.T) {
+	dir := writeTickets(t, map[string]string{
+		"12.json":  "12",
+		"7.json":   "7",
+		"100.json": "100",
+		"3.json":   "abc",
+		"4.json":   "04",
+		"5.json":   "",
+	})
+
+	tickets, problems := readTickets(dir)
+
+	var ids []string
+	for _, tk := range tickets {
+		ids = append(ids, tk.ID)
+	}
+	// Numeric order, not string order, and only numeric ids.
+	if got, want := strings.Join(ids, ","), "7,12,100"; got != want {
+		t.Errorf("indexed ids = %v, want %v", got, want)
+	}
+
+	if len(problems) != 3 {
+		t.Fatalf("got %d problems, want 3: %q", len(problems), problems)
+	}
+	for _, want := range []string{`"abc"`, `"04"`, `""`} {
+		found := false
+		for _, p := range problems {
+			if strings.Contains(p, want) && strings.Contains(p, "not numeric") {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no not-numeric problem for id %s in %q", want, problems)
+		}
+	}
+}
+
+// makeTickets returns n tickets numbered from 1.
+func makeTickets(n int) []ticket {
+	tickets := make([]ticket, n)
+	for i := range tickets {
+		id := i + 1
+		tickets[i] = ticket{
+			ID:      strconv.Itoa(id),
+			id:      id,
+			Status:  "open",
+			Subject: fmt.Sprintf("ticket number %d", id),
+		}
+	}
+	return tickets
+}
+
+func TestBuildBleveIndexDocCount(t *testing.T) {
+	const n = 25
+	for _, batchSize := range []int{1, 7, 10, 25, 100} {
+		out := filepath.Join(t.TempDir(), "bleve")
+		if err := buildBleveIndex(makeTickets(n), out, upsidedown.Name, batchSize, nil); err != nil {
+			t.Errorf("batch size %d: buildBleveIndex: %v", batchSize, err)
+			continue
+		}
+		index, err := bleve.Open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count, err := index.DocCount()
+		index.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != n {
+			t.Errorf("batch size %d: %d documents indexed, want %d", batchSize, count, n)
+		}
+	}
+}
+
+// TestPhraseSearch checks how quoted phrases behave with the ticket
+// mapping, as the README describes.
+func TestPhraseSearch(t *testing.T) {
+	m := bleve.NewIndexMapping()
+	setupTicketMapping(m, "en")
+	index, err := bleve.NewMemOnly(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for _, doc := range []indexedTicket{
+		{ID: 12, Status: "open", Subject: "Ticket 12 about Perl", AttachmentContent: "the quick brown fox"},
+		{ID: 13, Status: "open", Subject: "Perl about ticket 13"},
+	} {
+		if err := index.Index(strconv.Itoa(doc.ID), doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		q    string
+		want string // matching ids
+	}{
+		{`subject:"ticket 12 about perl"`, "12"},
+		{`subject:"tickets 12 about perl"`, "12"}, // stemmed
+		{`subject:"ticket 12 perl"`, ""},          // the stop word keeps its place
+		{`subject:"perl about ticket"`, "13"},
+		{`"12 about"`, "12"},
+		{`attachment_content:"quick brown"`, ""}, // no term vectors
+		{`attachment_content:quick`, "12"},
+	}
+	for _, tc := range tests {
+		req := bleve.NewSearchRequest(bleve.NewQueryStringQuery(tc.q))
+		res, err := index.Search(req)
+		if err != nil {
+			t.Errorf("%v: %v", tc.q, err)
+			continue
+		}
+		var ids []string
+		for _, h := range res.Hits {
+			ids = append(ids, h.ID)
+		}
+		sort.Strings(ids)
+		if got := strings.Join(ids, ","); got != tc.want {
+			t.Errorf("%v: matched %q, want %q", tc.q, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/rspier/rt-static/readers"
+)
+
+// ticketFileRe matches the names of ticket files, as opposed to index.json
+// and friends.
+var ticketFileRe = regexp.MustCompile(`(^|/)\d+\.json$`)
+
+// ticketSource enumerates the ticket files under a data path.
+type ticketSource struct {
+	count int // number of ticket files
+	// walk calls fn for each ticket file with a function to read it.
+	// read may be called after walk returns, but not after close.
+	walk  func(fn func(name string, read func() ([]byte, error))) error
+	close func() error
+}
+
+// openTicketSource reads tickets from a directory, a zip file, or a
+// gzipped tar file, depending on root's name.
+func openTicketSource(root string) (*ticketSource, error) {
+	switch {
+	case strings.HasSuffix(root, ".zip"):
+		return zipTicketSource(root)
+	case strings.HasSuffix(root, ".tar.gz"), strings.HasSuffix(root, ".tgz"):
+		return tarTicketSource(root)
+	}
+	return dirTicketSource(root)
+}
+
+func nopClose() error { return nil }
+
+func dirTicketSource(root string) (*ticketSource, error) {
+	all, err := filepath.Glob(filepath.Join(root, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, f := range all {
+		if ticketFileRe.MatchString(f) {
+			files = append(files, f)
+		}
+	}
+	return &ticketSource{
+		count: len(files),
+		walk: func(fn func(string, func() ([]byte, error))) error {
+			for _, f := range files {
+				f := f
+				fn(f, func() ([]byte, error) { return ioutil.ReadFile(f) })
+			}
+			return nil
+		},
+		close: nopClose,
+	}, nil
+}
+
+// zipTicketSource uses the same reader as the server.
+func zipTicketSource(root string) (*ticketSource, error) {
+	zr, err := readers.NewZipReader(root)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for name := range zr.Files {
+		if ticketFileRe.MatchString(name) {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	return &ticketSource{
+		count: len(files),
+		walk: func(fn func(string, func() ([]byte, error))) error {
+			for _, f := range files {
+				f := f
+				fn(root+":"+f, func() ([]byte, error) {
+					r, err := zr.GetFile(f)
+					if err != nil {
+						return nil, err
+					}
+					defer r.Close()
+					return ioutil.ReadAll(r)
+				})
+			}
+			return nil
+		},
+		close: zr.Close,
+	}, nil
+}
+
+// eachTarFile calls fn with each ticket file in a gzipped tar.
+func eachTarFile(fn string, f func(name string, r io.Reader) error) error {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	zr, err := gzip.NewReader(fh)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg || !ticketFileRe.MatchString(h.Name) {
+			continue
+		}
+		if err := f(h.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// tarTicketSource streams a gzipped tar.  There's no random access, so
+// each file is read as walk reaches it, and the archive is read once up
+// front just to count the tickets for the progress bar.
+func tarTicketSource(root string) (*ticketSource, error) {
+	count := 0
+	err := eachTarFile(root, func(string, io.Reader) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ticketSource{
+		count: count,
+		walk: func(fn func(string, func() ([]byte, error))) error {
+			return eachTarFile(root, func(name string, r io.Reader) error {
+				b, err := ioutil.ReadAll(r)
+				fn(root+":"+name, func() ([]byte, error) { return b, err })
+				return nil
+			})
+		},
+		close: nopClose,
+	}, nil
+}
@@ -0,0 +1,171 @@
+// render writes every indexed ticket page as static HTML
+package main
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rspier/rt-static/data"
+	"github.com/rspier/rt-static/web"
+	"github.com/schollz/progressbar/v2"
+)
+
+const snapshotFormat = "2006-01-02T15:04"
+
+// The page flags match the server's, and the address obfuscation ones are
+// shared with it, so the static pages look the same as the served ones.
+var (
+	dataPath       = flag.String("data", "/big/rt-static/out/", "path to json data; a list like updates:base.zip is searched in order")
+	indexPath      = flag.String("index", filepath.Join(*dataPath, "index.bleve"), "path to bleve index")
+	outDir         = flag.String("outdir", "rendered", "directory to write N.html files to")
+	prefix         = flag.String("prefix", "", "URL Prefix")
+	site           = flag.String("site", "Perl 5 RT Archive", "Site Title")
+	shortSite      = flag.String("shortsite", "Perl 5", "Short name of Site")
+	gitHubPrefix   = flag.String("githubprefix", "https://github.com/perl/perl5", "Prefix of GitHub links")
+	gitHubPath     = flag.String("githubpath", "/issues/{id}", "path appended to -githubprefix for a ticket's GitHub link, {id} is the GitHub number")
+	displayPath    = flag.String("displaypath", "/Ticket/Display.html", "path of the ticket pages, under -prefix")
+	searchPath     = flag.String("searchpath", "/Search/Simple.html", "path of the search page, under -prefix")
+	canonicalHost  = flag.String("canonicalhost", "", "host name used for canonical links, if set")
+	snapshotTime   = flag.String("snapshot", "", "when was the data archive created: "+snapshotFormat)
+	hideStatuses   = flag.String("hidestatuses", "", "comma separated ticket statuses, like rejected,spam, not rendered")
+	logoURL        = flag.String("logo", "", "URL of a logo shown next to the site name")
+	cssURL         = flag.String("css", "", "URL of an extra stylesheet")
+	headerHTMLFile = flag.String("headerhtml", "", "file of trusted HTML <li> items added to the navigation bar")
+	footerHTMLFile = flag.String("footerhtml", "", "file of trusted HTML added to the footer")
+	setObfuscation = web.ObfuscationFlags(flag.CommandLine)
+)
+
+func main() {
+	flag.Parse()
+
+	var sTime time.Time
+	if *snapshotTime != "" {
+		var err error
+		sTime, err = time.Parse(snapshotFormat, *snapshotTime)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := setObfuscation(); err != nil {
+		log.Fatal(err)
+	}
+
+	// The snippets are the operator's own, so are trusted as HTML.
+	readHTML := func(fn string) template.HTML {
+		if fn == "" {
+			return ""
+		}
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return template.HTML(b)
+	}
+
+	tix, err := data.New(*dataPath, *indexPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tix.Close()
+
+	s := &web.Server{
+		Tix:           tix,
+		Prefix:        *prefix,
+		Site:          *site,
+		ShortSite:     *shortSite,
+		GitHubPrefix:  *gitHubPrefix,
+		GitHubPath:    *gitHubPath,
+		DisplayPath:   *displayPath,
+		SearchPath:    *searchPath,
+		CanonicalHost: *canonicalHost,
+		SnapshotTime:  sTime,
+		LogoURL:       *logoURL,
+		CSSURL:        *cssURL,
+		HeaderHTML:    readHTML(*headerHTMLFile),
+		FooterHTML:    readHTML(*footerHTMLFile),
+	}
+	for _, st := range strings.Split(*hideStatuses, ",") {
+		if st = strings.TrimSpace(st); st != "" {
+			if s.HiddenStatuses == nil {
+				s.HiddenStatuses = make(map[string]bool)
+			}
+			s.HiddenStatuses[st] = true
+		}
+	}
+
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	ids := tix.TicketIDs()
+	pb := progressbar.NewOptions(len(ids), progressbar.OptionSetDescription("rendering"))
+	failed, hidden := 0, 0
+	for _, id := range ids {
+		pb.Add(1)
+		err := renderTicket(s, id)
+		switch {
+		case errors.Is(err, web.ErrHidden):
+			hidden++
+		case err != nil:
+			log.Printf("ticket %v: %v", id, err)
+			failed++
+		}
+	}
+	pb.Finish()
+	pb.Clear()
+
+	fmt.Printf("rendered %d tickets to %v, %d hidden\n", len(ids)-failed-hidden, *outDir, hidden)
+	if failed > 0 {
+		log.Fatalf("%d tickets failed", failed)
+	}
+}
+
+// renderTicket writes id.html.  A page that fails part way is removed
+// rather than left half written, as is one from an earlier run for a
+// ticket that's now hidden.
+func renderTicket(s *web.Server, id string) error {
+	fn := filepath.Join(*outDir, id+".html")
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = s.RenderTicket(context.Background(), w, id)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fn)
+	}
+	return err
+}
@@ -20,6 +20,7 @@ import (
 	"archive/zip"
 	"flag"
 	"fmt"
+	"html/template"
 	"io"
 	"io/ioutil"
 	"log"
@@ -30,90 +31,286 @@ import (
 	"time"
 
 	"github.com/rspier/rt-static/data"
+	"github.com/rspier/rt-static/readers"
+	"github.com/rspier/rt-static/version"
 	"github.com/rspier/rt-static/web"
+	"github.com/rspier/rt-static/web/page"
 
 	"github.com/golang/glog"
 )
 
 const snapshotFormat = "2006-01-02T15:04"
 
-var serverVersion = "unknown" // set to version at build time
-
 var (
-	dataPath     = flag.String("data", "/big/rt-static/out/", "path to json data")
-	indexPath    = flag.String("index", filepath.Join(*dataPath, "index.bleve"), "path to bleve index")
-	port         = flag.Int("port", 8080, "port to listen on")
-	prefix       = flag.String("prefix", "", "URL Prefix")
-	site         = flag.String("site", "Perl 5 RT Archive", "Site Title")
-	shortSite    = flag.String("shortsite", "Perl 5", "Short name of Site")
-	gitHubPrefix = flag.String("githubprefix", "https://github.com/perl/perl5", "Prefix of GitHub links")
-	staticDir    = flag.String("dir", "web/static", "the directory to serve files from. Defaults to web/static")
-	snapshotTime = flag.String("snapshot", "", "when was the data archive created: "+snapshotFormat)
+	dataPath       = flag.String("data", "/big/rt-static/out/", "path to json data; a list like updates:base.zip is searched in order")
+	indexPath      = flag.String("index", filepath.Join(*dataPath, "index.bleve"), "path to bleve index")
+	port           = flag.Int("port", 8080, "port to listen on")
+	prefix         = flag.String("prefix", "", "URL Prefix")
+	site           = flag.String("site", "Perl 5 RT Archive", "Site Title")
+	shortSite      = flag.String("shortsite", "Perl 5", "Short name of Site")
+	gitHubPrefix   = flag.String("githubprefix", "https://github.com/perl/perl5", "Prefix of GitHub links")
+	gitHubPath     = flag.String("githubpath", "/issues/{id}", "path appended to -githubprefix for a ticket's GitHub link, {id} is the GitHub number")
+	displayPath    = flag.String("displaypath", "/Ticket/Display.html", "path of the ticket pages, under -prefix")
+	searchPath     = flag.String("searchpath", "/Search/Simple.html", "path of the search page, under -prefix")
+	staticDir      = flag.String("dir", "web/static", "the directory to serve files from. Defaults to web/static")
+	snapshotTime   = flag.String("snapshot", "", "when was the data archive created: "+snapshotFormat)
+	requireIndexed = flag.Bool("requireindexed", false, "only serve tickets that are listed in index.json")
+	exportMaxRows  = flag.Int("exportmaxrows", 100000, "maximum number of rows in a CSV export")
+	resultFields   = flag.String("resultfields", "id,subject,status", "comma separated stored fields to show in search results")
+	maxAttachment  = flag.Int("maxattachment", 0, "largest attachment to serve, in bytes. 0 for no limit")
+	zipCacheDir    = flag.String("zipcachedir", "", "directory to cache each ticket's attachments.zip in, so downloads can resume; zips are streamed uncached if unset")
+	csp            = flag.String("csp", web.DefaultCSP, "Content-Security-Policy header; empty to send none")
+	referrerPolicy = flag.String("referrerpolicy", "strict-origin-when-cross-origin", "Referrer-Policy header; empty to send none")
+	frameOptions   = flag.String("frameoptions", "DENY", "X-Frame-Options header; empty to send none")
+	maxTxns        = flag.Int("maxtransactions", 0, "transactions and attachments shown on a ticket page before a link to the rest. 0 for no limit")
+	adminTokenFile = flag.String("admintokenfile", "", "file containing the bearer token for the admin endpoints, such as POST /admin/reload; implies -readonlyindex. Admin endpoints are disabled if unset")
+	searchRate     = flag.Float64("searchrate", 0, "searches and CSV exports per second allowed per client. 0 for no limit")
+	searchBurst    = flag.Int("searchburst", 10, "burst of searches allowed per client when -searchrate is set")
+	realIP         = flag.String("realip", "", "comma separated IPs or CIDRs of trusted proxies whose X-Forwarded-For/X-Real-IP headers are used for the client address")
+	canonicalHost  = flag.String("canonicalhost", "", "host name to redirect all requests to, if set")
+	showVersion    = flag.Bool("version", false, "print the version and exit")
+	defaultQuery   = flag.String("defaultquery", "status:*", "query used for the landing page, the recent tickets shown for an empty search, and \"*\" searches")
+	gitHubMap      = flag.String("githubmap", data.RTGitHubCSV, "file in the data mapping RT tickets to GitHub issues; .tsv files are tab separated")
+	gitHubMapKey   = flag.String("githubmapkey", "0", "column of -githubmap with the RT id: a number from 0 or a header name")
+	gitHubMapValue = flag.String("githubmapvalue", "1", "column of -githubmap with the GitHub issue: a number from 0 or a header name")
+	logoURL        = flag.String("logo", "", "URL of a logo shown next to the site name")
+	cssURL         = flag.String("css", "", "URL of an extra stylesheet")
+	headerHTMLFile = flag.String("headerhtml", "", "file of trusted HTML <li> items added to the navigation bar")
+	footerHTMLFile = flag.String("footerhtml", "", "file of trusted HTML added to the footer")
+	setObfuscation = web.ObfuscationFlags(flag.CommandLine)
+	maxBuffered    = flag.Int("maxbufferedpage", page.MaxBuffered, "largest rendered page buffered to send a Content-Length, in bytes. 0 to stream every page")
+	waitRetries    = flag.Int("waitretries", 10, "times to retry opening the data at startup before giving up")
+	waitInterval   = flag.Duration("waitinterval", 5*time.Second, "first delay between attempts to open the data, doubling up to a minute")
+	compress       = flag.String("compress", "br,gzip", "comma separated content encodings for pages (br, gzip), most preferred first; empty disables compression")
+	gzipLevel      = flag.Int("gziplevel", 0, "gzip level, 1-9; 0 for the default")
+	brotliLevel    = flag.Int("brotlilevel", 0, "brotli level, 0-11; 0 for the default, 6")
+	maxDecodes     = flag.Int("maxattachmentdecodes", 0, "attachments decoded and served at once; 0 for no limit")
+	attachmentWait = flag.Duration("attachmentwait", 2*time.Second, "how long an attachment request waits for -maxattachmentdecodes before a 503")
+	searchOnly     = flag.Bool("searchonly", false, "serve searches only, without loading index.json; ticket and attachment pages are unavailable")
+	latin1         = flag.Bool("latin1", false, "read ticket files that aren't valid UTF-8 as ISO-8859-1")
+	noTimeout      = flag.Bool("notimeout", false, "don't time out requests, for debugging handlers")
+	logSample      = flag.Int("logsample", 1, "log one in this many successful requests; errors and slow requests are always logged")
+	logOnlyErrors  = flag.Bool("logonlyerrors", false, "log only errors and slow requests")
+	logSlow        = flag.Duration("logslow", time.Second, "requests taking at least this long are always logged")
+	hideStatuses   = flag.String("hidestatuses", "", "comma separated ticket statuses, like rejected,spam, left out of searches and not served")
+	zipIndexPath   = flag.String("zipindexpath", "index.bleve", "directory inside an -index zip holding the bleve index, / for the top level")
+	zipIndexCache  = flag.String("zipindexcache", "", "directory to keep the index extracted from an -index zip in, reused until the zip changes; a new temporary directory each start if unset")
+	attachmentMap  = flag.String("attachmentmap", "", "file to keep the attachment to ticket map in, rather than memory, for archives with millions of attachments; rewritten at each load")
+	readOnlyIndex  = flag.Bool("readonlyindex", false, "open the bleve index read-only, so several servers can share it")
+	zipPrefix      = flag.String("zipprefix", "", "directory inside -data zips holding the tickets, / for the top level; by default the directory all the zip's files are in")
 )
 
-func waitForFile(f string, r int, d time.Duration) error {
-	for c := 0; c < r; c++ {
-		_, err := os.Stat(f)
+// bleveIndexPath returns the bleve index to open: -index, or where it's
+// extracted to if it's a zip.  It's called at each load, so a reload
+// picks up a new zip.
+func bleveIndexPath() (string, error) {
+	if !strings.HasSuffix(*indexPath, ".zip") {
+		return *indexPath, nil
+	}
+	return extractIndexBleve(*indexPath, *zipIndexPath, *zipIndexCache)
+}
+
+func newData() (*data.Data, error) {
+	index, err := bleveIndexPath()
+	if err != nil {
+		return nil, err
+	}
+	return data.NewWithOptions(*dataPath, index, data.Options{
+		GitHubMap: data.GitHubMapOptions{
+			File:  *gitHubMap,
+			Key:   *gitHubMapKey,
+			Value: *gitHubMapValue,
+		},
+		SearchOnly:     *searchOnly,
+		ZipPrefix:      *zipPrefix,
+		ReadOnlyIndex:  *readOnlyIndex,
+		AttachmentFile: *attachmentMap,
+	})
+}
+
+// maxWaitInterval caps the backoff in openData.
+const maxWaitInterval = time.Minute
+
+// openData opens the data, retrying with backoff while it's missing or
+// doesn't open, for example while it's still being synced from elsewhere.
+// Failures are logged at most once a minute.
+func openData(retries int, interval time.Duration) (*data.Data, error) {
+	start := time.Now()
+	var logged time.Time
+	for c := 0; ; c++ {
+		tix, err := newData()
 		if err == nil {
-			return nil
+			return tix, nil
+		}
+		if c >= retries {
+			return nil, fmt.Errorf("data still doesn't open after waiting %v: %w", time.Since(start).Round(time.Second), err)
+		}
+		if time.Since(logged) >= time.Minute {
+			glog.Infof("data not ready after %v, retrying: %v", time.Since(start).Round(time.Second), err)
+			logged = time.Now()
+		}
+		time.Sleep(interval)
+		interval *= 2
+		if interval > maxWaitInterval {
+			interval = maxWaitInterval
 		}
-		glog.Infof("file %q not found after %v", f, time.Duration(c)*d)
-		time.Sleep(d)
 	}
-	return fmt.Errorf("file %q still doesn't exist after waiting %v", f, d*time.Duration(r))
-
 }
 
-// extract the index.bleve directory from the provided zipfile
-func extractIndexBleve(filename string) (string, error) {
-	z, err := zip.OpenReader(filename)
+// extractIndexBleve extracts the bleve index stored under dir in the
+// provided zipfile to the cache directory, and returns its path.  bleve
+// needs real files, so the index can't be opened in the zip.  It's
+// extracted once per version of the zip (by modification time and size),
+// and later loads reuse it.
+func extractIndexBleve(filename, dir, cache string) (string, error) {
+	fi, err := os.Stat(filename)
 	if err != nil {
 		return "", err
 	}
-	defer z.Close()
+	base := strings.TrimSuffix(filepath.Base(filename), ".zip") + "-"
+	key := fmt.Sprintf("%s%d-%d", base, fi.ModTime().Unix(), fi.Size())
+	final := filepath.Join(cache, key)
+	db := filepath.Join(final, "index.bleve")
+	if _, err := os.Stat(filepath.Join(db, "index_meta.json")); err == nil {
+		glog.Infof("using bleve index extracted from %v in %v", filename, db)
+		return db, nil
+	}
 
-	d, err := ioutil.TempDir("", "bleve")
+	// Extract to the side and rename, so an interrupted extraction is
+	// never mistaken for a complete one.
+	if err := os.MkdirAll(cache, 0700); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempDir(cache, "."+key+".tmp")
 	if err != nil {
 		return "", err
 	}
+	if err := extractIndexBleveTo(filename, dir, filepath.Join(tmp, "index.bleve")); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	os.RemoveAll(final) // an incomplete one
+	if err := os.Rename(tmp, final); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+
+	// Older versions of the same zip won't be used again.
+	old, _ := filepath.Glob(filepath.Join(cache, base+"[0-9]*-[0-9]*"))
+	for _, o := range old {
+		if o != final {
+			glog.Infof("removing old extracted index %v", o)
+			os.RemoveAll(o)
+		}
+	}
+	return db, nil
+}
+
+// extractIndexBleveTo extracts the bleve index under dir in filename to
+// the new directory db.
+func extractIndexBleveTo(filename, dir, db string) error {
+	z, err := zip.OpenReader(filename)
+	if err != nil {
+		return err
+	}
+	defer z.Close()
 
-	db := filepath.Join(d, "index.bleve")
 	err = os.Mkdir(db, 0700)
 	if err != nil {
-		return "", err
+		return err
 	}
 
+	// "" or "/" is the top level of the zip.
+	prefix := strings.Trim(dir, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	n := 0
 	for _, f := range z.File {
-		if !strings.HasPrefix(f.Name, "index.bleve") {
-			continue
-		}
-		if f.FileInfo().IsDir() {
+		if !strings.HasPrefix(f.Name, prefix) || f.FileInfo().IsDir() {
 			continue
 		}
-
-		in, err := f.Open()
+		err = extractFile(f, db, f.Name[len(prefix):])
 		if err != nil {
-			return "", err
+			return err
 		}
-		defer in.Close()
+		n++
+	}
+	if n == 0 {
+		return fmt.Errorf("no bleve index under %v in %v (set -zipindexpath); the zip has: %v",
+			prefix, filename, strings.Join(topLevel(z.File), ", "))
+	}
+	glog.Infof("extracted %d bleve files from %v to %v", n, filename, db)
+	return nil
+}
 
-		out, err := os.OpenFile(filepath.Join(d, f.Name), os.O_CREATE|os.O_WRONLY, 0700)
-		if err != nil {
-			return "", err
+// extractFile writes f to name under dir.
+func extractFile(f *zip.File, dir, name string) error {
+	fn := filepath.Join(dir, filepath.FromSlash(name))
+	if !strings.HasPrefix(fn, dir+string(filepath.Separator)) {
+		return fmt.Errorf("%v: path escapes the index directory", f.Name)
+	}
+	if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+		return err
+	}
+	in, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY, 0700)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cErr := out.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// topLevel returns the distinct top level names in a zip, with a trailing
+// "/" for directories, for error messages.
+func topLevel(files []*zip.File) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, f := range files {
+		name := f.Name
+		if i := strings.Index(name, "/"); i >= 0 {
+			name = name[:i+1]
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
 		}
-		defer out.Close()
+	}
+	return names
+}
 
-		_, err = io.Copy(out, in)
-		if err != nil {
-			return "", err
+// splitList splits a comma separated flag value, trimming spaces around
+// the entries and dropping empty ones.
+func splitList(s string) []string {
+	var l []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
 		}
 	}
-	return db, nil
+	return l
 }
 
 func main() {
 	flag.Parse()
 	var err error
+	readers.Latin1Fallback = *latin1
+
+	v := version.Get()
+	if *showVersion {
+		fmt.Println(v)
+		return
+	}
+	glog.Infof("server version %v", v)
 
 	var sTime time.Time
 	if *snapshotTime != "" {
@@ -123,35 +320,120 @@ func main() {
 		}
 	}
 
-	if strings.HasSuffix(*indexPath, ".zip") {
-		*indexPath, err = extractIndexBleve(*indexPath)
+	if strings.HasSuffix(*indexPath, ".zip") && *zipIndexCache == "" {
+		// For this run only.  A reload extracts a changed zip next to the
+		// first and removes the old one.
+		*zipIndexCache, err = ioutil.TempDir("", "bleve")
 		if err != nil {
 			glog.Fatal(err)
 		}
 	}
 
-	// Allow for the data files not to exist at start up (for example,
-	// if they're being synced from elsehwere.)
-	err = waitForFile(filepath.Join(*indexPath, "store"), 10, 30*time.Second)
+	var adminToken string
+	if *adminTokenFile != "" {
+		b, err := ioutil.ReadFile(*adminTokenFile)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		adminToken = strings.TrimSpace(string(b))
+		// A reload opens the new index while the old one is still open,
+		// which only works if neither holds it exclusively.
+		if !*readOnlyIndex {
+			glog.Info("-admintokenfile enables reloads, so the index is opened read-only")
+			*readOnlyIndex = true
+		}
+	}
+
+	// Allow for the data files not to exist, or to be incomplete, at
+	// start up (for example, if they're being synced from elsewhere.)
+	tix, err := openData(*waitRetries, *waitInterval)
 	if err != nil {
 		glog.Fatal(err)
 	}
 
-	data, err := data.New(*dataPath, *indexPath)
-	defer data.Close()
+	trustedProxies, err := web.ParseTrustedProxies(*realIP)
 	if err != nil {
 		glog.Fatal(err)
 	}
 
+	if err := setObfuscation(); err != nil {
+		glog.Fatal(err)
+	}
+
+	var compression []string
+	for _, enc := range strings.Split(*compress, ",") {
+		switch enc = strings.TrimSpace(enc); enc {
+		case "":
+		case "br", "gzip":
+			compression = append(compression, enc)
+		default:
+			glog.Fatalf("-compress: unknown encoding %q", enc)
+		}
+	}
+
+	hidden := make(map[string]bool)
+	for _, st := range splitList(*hideStatuses) {
+		hidden[st] = true
+	}
+
+	page.MaxBuffered = *maxBuffered
+
+	// The snippets are the operator's own, so are trusted as HTML.
+	readHTML := func(fn string) template.HTML {
+		if fn == "" {
+			return ""
+		}
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		return template.HTML(b)
+	}
+
 	s := &web.Server{
-		Prefix:        *prefix,
-		Tix:           data,
-		Site:          *site,
-		ShortSite:     *shortSite,
-		StaticDir:     *staticDir,
-		GitHubPrefix:  *gitHubPrefix,
-		SnapshotTime:  sTime,
-		ServerVersion: serverVersion,
+		Prefix:               *prefix,
+		Tix:                  tix,
+		Site:                 *site,
+		ShortSite:            *shortSite,
+		StaticDir:            *staticDir,
+		GitHubPrefix:         *gitHubPrefix,
+		GitHubPath:           *gitHubPath,
+		DisplayPath:          *displayPath,
+		SearchPath:           *searchPath,
+		SnapshotTime:         sTime,
+		ServerVersion:        v.Version,
+		DefaultQuery:         *defaultQuery,
+		RequireIndexed:       *requireIndexed,
+		ExportMaxRows:        *exportMaxRows,
+		ResultFields:         splitList(*resultFields),
+		MaxAttachmentBytes:   *maxAttachment,
+		AdminToken:           adminToken,
+		SearchRate:           *searchRate,
+		SearchBurst:          *searchBurst,
+		TrustedProxies:       trustedProxies,
+		CanonicalHost:        *canonicalHost,
+		LogoURL:              *logoURL,
+		CSSURL:               *cssURL,
+		HeaderHTML:           readHTML(*headerHTMLFile),
+		FooterHTML:           readHTML(*footerHTMLFile),
+		Compression:          compression,
+		GzipLevel:            *gzipLevel,
+		BrotliLevel:          *brotliLevel,
+		NoTimeout:            *noTimeout,
+		MaxAttachmentDecodes: *maxDecodes,
+		MaxTransactions:      *maxTxns,
+		ZipCacheDir:          *zipCacheDir,
+		CSP:                  *csp,
+		ReferrerPolicy:       *referrerPolicy,
+		FrameOptions:         *frameOptions,
+		AttachmentWait:       *attachmentWait,
+		LogSample:            *logSample,
+		LogOnlyErrors:        *logOnlyErrors,
+		LogSlow:              *logSlow,
+		HiddenStatuses:       hidden,
+		Reload: func() (*data.Data, error) {
+			return newData()
+		},
 	}
 	r := s.NewRouter()
 	sm := http.NewServeMux()
@@ -0,0 +1,127 @@
+package data
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// attachmentPair is an attachment id and the id of its ticket.
+type attachmentPair struct {
+	attachment, ticket uint64
+}
+
+// parseID returns id as a number if it's one written the usual way, so
+// that formatting the number gives id back.  Ids like "0123" or "+5"
+// can't go in an attachmentFile.
+func parseID(id string) (uint64, bool) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil || strconv.FormatUint(n, 10) != id {
+		return 0, false
+	}
+	return n, true
+}
+
+// attachmentRecordSize is the size of an attachmentPair in an
+// attachmentFile: two big endian uint64s.
+const attachmentRecordSize = 16
+
+// attachmentFile maps attachment ids to ticket ids from a file of
+// attachmentPairs sorted by attachment.  Lookups binary search it with
+// ReadAt, so only the operating system's page cache holds any of it in
+// memory, and only the parts that are used.
+type attachmentFile struct {
+	f *os.File
+	n int // records
+}
+
+// writeAttachmentFile writes pairs, which it sorts, to fn and opens it.
+// Where an attachment appears more than once the last pair wins, as it
+// would in a map.
+func writeAttachmentFile(fn string, pairs []attachmentPair) (*attachmentFile, error) {
+	sort.SliceStable(pairs, func(a, b int) bool { return pairs[a].attachment < pairs[b].attachment })
+	uniq := pairs[:0]
+	for _, p := range pairs {
+		if len(uniq) > 0 && uniq[len(uniq)-1].attachment == p.attachment {
+			uniq[len(uniq)-1] = p
+			continue
+		}
+		uniq = append(uniq, p)
+	}
+
+	// Written to the side and renamed, so a server still using the old
+	// file (or a crash part way) never sees a partial one.
+	tmp, err := ioutil.TempFile(filepath.Dir(fn), "."+filepath.Base(fn)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+	w := bufio.NewWriter(tmp)
+	var rec [attachmentRecordSize]byte
+	for _, p := range uniq {
+		binary.BigEndian.PutUint64(rec[:8], p.attachment)
+		binary.BigEndian.PutUint64(rec[8:], p.ticket)
+		w.Write(rec[:]) // the error sticks, for Flush
+	}
+	err = w.Flush()
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), fn); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	return &attachmentFile{f: f, n: len(uniq)}, nil
+}
+
+// get returns the ticket attachment id belongs to.
+func (a *attachmentFile) get(id string) (string, bool) {
+	att, ok := parseID(id)
+	if !ok {
+		return "", false
+	}
+	var rec [attachmentRecordSize]byte
+	var readErr error
+	read := func(i int) uint64 {
+		if _, err := a.f.ReadAt(rec[:], int64(i)*attachmentRecordSize); err != nil {
+			readErr = err
+		}
+		return binary.BigEndian.Uint64(rec[:8])
+	}
+	i := sort.Search(a.n, func(i int) bool { return readErr != nil || read(i) >= att })
+	if readErr != nil || i == a.n || read(i) != att {
+		return "", false
+	}
+	return strconv.FormatUint(binary.BigEndian.Uint64(rec[8:]), 10), true
+}
+
+func (a *attachmentFile) Close() error {
+	return a.f.Close()
+}
@@ -16,20 +16,27 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/blevesearch/bleve"
 	"github.com/golang/glog"
 	"github.com/rspier/rt-static/readers"
+	_ "github.com/rspier/rt-static/synonym" // filter used by indexes built with -synonyms
 )
 
 // TicketSource describes the interface of the ticket reader classes we use.
@@ -37,58 +44,266 @@ type TicketSource interface {
 	GetTicket(id string) (interface{}, error)
 	GetJSON(id string) (io.ReadCloser, error)
 	GetFile(id string) (io.ReadCloser, error)
+	TicketIDs() ([]string, error)
+	Close() error
 }
 
 // TODO: fixme data.Data stutters
 type Data struct {
-	// attachmentMetaMap maps between AttachmentId and and AttachmentMeta struct.
-	ts                TicketSource
-	attachmentMetaMap map[string]AttachmentMeta
+	ts TicketSource
+	// attachmentTickets maps from AttachmentId to the TicketId it belongs to.
+	// With Options.AttachmentFile it's empty, and attachmentFile is used
+	// instead, built from attachmentPairs.
+	attachmentTickets map[string]string
+	attachmentFile    *attachmentFile
+	attachmentPairs   []attachmentPair
 	ticketIndex       []*IndexTicket
+	ticketsByID       map[string]*IndexTicket
+	statuses          map[string]int // ticket count by status
 	rtGitHubMap       map[string]string
+	gitHubRTMap       map[string]string // the reverse of rtGitHubMap
 	Index             bleve.Index
 	Merged            map[string]string
+	Loaded            time.Time // when New finished loading
+	opts              Options
 }
 
-func New(dataPath string, indexPath string) (*Data, error) {
-	var ticketSource TicketSource
-	var err error
-	if strings.HasSuffix(dataPath, ".zip") {
-		ticketSource, err = readers.NewZipReader(dataPath)
-	} else {
-		ticketSource, err = readers.NewFileReader(dataPath)
+// Options configures how the data is loaded.  The zero value gives the
+// defaults.
+type Options struct {
+	GitHubMap GitHubMapOptions
+	// SearchOnly skips loading index.json, which is most of the memory
+	// and startup time, for an instance that only serves searches.
+	// Tickets and attachments then fail with ErrSearchOnly, and
+	// Statuses, SimilarTickets and TicketIDs come back empty.
+	SearchOnly bool
+	// ZipPrefix is the directory inside data zip files holding the
+	// tickets, "/" for the top level.  If it's empty, the directory all of
+	// a zip's files are in is used.
+	ZipPrefix string
+	// AttachmentFile, if set, is a file to keep the map from attachments
+	// to their tickets in, rather than memory, for archives with millions
+	// of attachments.  It's rewritten on every load.  Attachment and
+	// ticket ids must be numbers; if they aren't, the map stays in memory.
+	AttachmentFile string
+	// ReadOnlyIndex opens the bleve index read-only, which takes a shared
+	// lock, so several servers can use one index directory at once.  An
+	// index that can't be opened read-only is opened as usual.
+	ReadOnlyIndex bool
+}
+
+// GitHubMapOptions describes the file mapping RT tickets to GitHub issues.
+type GitHubMapOptions struct {
+	// File is the name of the map, RTGitHubCSV if unset.  Files ending in
+	// .tsv are read as tab separated, others as comma separated.
+	File string
+	// Key and Value are the columns holding the RT id and the GitHub
+	// issue: either numbers counting from 0, or names looked up in a
+	// header row.  They default to "0" and "1".
+	Key, Value string
+}
+
+func (o GitHubMapOptions) file() string {
+	if o.File == "" {
+		return RTGitHubCSV
 	}
+	return o.File
+}
+
+// New opens the tickets at dataPath and the bleve index at indexPath.
+// dataPath may list several directories or zip files separated by the OS
+// path list separator (":" on Unix); earlier entries take precedence, so
+// "updates:base.zip" serves newer tickets from updates and everything
+// else from base.zip.
+func New(dataPath string, indexPath string) (*Data, error) {
+	return NewWithOptions(dataPath, indexPath, Options{})
+}
+
+// NewWithOptions is New with non-default Options.
+func NewWithOptions(dataPath string, indexPath string, opts Options) (*Data, error) {
+	ticketSource, err := newTicketSource(dataPath, opts.ZipPrefix)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	glog.Info("done setting up ticketsource")
-	index, err := bleve.Open(indexPath)
+	index, err := openIndex(indexPath, opts.ReadOnlyIndex)
 	if err != nil {
-		log.Fatal(err)
+		ticketSource.Close()
+		return nil, fmt.Errorf("bleve.Open(%v): %w", indexPath, err)
 	}
 	glog.Info("done opening bleve")
-	d := Data{ts: ticketSource, Index: index}
+	d := Data{ts: ticketSource, Index: index, opts: opts}
 
-	err = d.newIndex()
+	err = d.load()
 	if err != nil {
+		// Don't hold on to the index lock, someone may try again.
+		index.Close()
+		ticketSource.Close()
+		if d.attachmentFile != nil {
+			d.attachmentFile.Close()
+		}
 		return nil, err
 	}
+	d.Loaded = time.Now()
+	d.logSummary()
+	d.checkMapping()
+
+	return &d, nil
+}
+
+// Summary counts what was loaded.
+type Summary struct {
+	Tickets        int    `json:"tickets"` // in index.json, 0 when search only
+	Documents      uint64 `json:"documents"`
+	Attachments    int    `json:"attachments"`
+	GitHubMappings int    `json:"github_mappings"`
+	Merged         int    `json:"merged"`
+}
+
+// Summary counts the loaded corpus.  The counts other than Documents are
+// still filled in if the index can't count its documents.
+func (d *Data) Summary() (Summary, error) {
+	docs, err := d.Index.DocCount()
+	if err != nil {
+		err = fmt.Errorf("bleve DocCount: %w", err)
+	}
+	return Summary{
+		Tickets:        len(d.ticketIndex),
+		Documents:      docs,
+		Attachments:    d.attachmentCount(),
+		GitHubMappings: len(d.rtGitHubMap),
+		Merged:         len(d.Merged),
+	}, err
+}
+
+// logSummary describes the loaded corpus, so it's obvious at startup
+// whether the data looks right.
+func (d *Data) logSummary() {
+	sum, err := d.Summary()
+	if err != nil {
+		glog.Warning(err)
+	}
+	if d.opts.SearchOnly {
+		glog.Infof("search only: %d documents in bleve, %d GitHub mappings, %d merged tickets",
+			sum.Documents, sum.GitHubMappings, sum.Merged)
+		return
+	}
+	glog.Infof("loaded %d tickets from index.json, %d documents in bleve, %d attachments, %d GitHub mappings, %d merged tickets",
+		sum.Tickets, sum.Documents, sum.Attachments, sum.GitHubMappings, sum.Merged)
+	if err == nil && sum.Documents != uint64(sum.Tickets) {
+		glog.Warningf("bleve has %d documents but index.json has %d tickets; were they built together?", sum.Documents, sum.Tickets)
+	}
+}
 
-	err = d.newRTGitHubMap()
+func openTicketSource(path, zipPrefix string) (TicketSource, error) {
+	if strings.HasSuffix(path, ".zip") {
+		if zipPrefix != "" {
+			return openZip(readers.NewZipReaderAt(path, zipPrefix))
+		}
+		return openZip(readers.NewZipReader(path))
+	}
+	fr, err := readers.NewFileReader(path)
 	if err != nil {
 		return nil, err
 	}
+	return fr, nil
+}
 
-	err = d.newMerged()
+// openZip avoids returning a non-nil TicketSource holding a nil reader.
+func openZip(ts TicketSource, err error) (TicketSource, error) {
 	if err != nil {
 		return nil, err
 	}
+	return ts, nil
+}
 
-	return &d, nil
+func newTicketSource(dataPath, zipPrefix string) (TicketSource, error) {
+	paths := filepath.SplitList(dataPath)
+	if len(paths) <= 1 {
+		return openTicketSource(dataPath, zipPrefix)
+	}
+	var srcs []readers.Source
+	for _, p := range paths {
+		ts, err := openTicketSource(p, zipPrefix)
+		if err != nil {
+			for _, s := range srcs {
+				s.Close()
+			}
+			return nil, err
+		}
+		srcs = append(srcs, ts)
+	}
+	return readers.NewFallbackReader(srcs...), nil
+}
+
+func (d *Data) load() error {
+	if !d.opts.SearchOnly {
+		err := d.newIndex()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := d.newRTGitHubMap()
+	if err != nil {
+		return err
+	}
+
+	return d.newMerged()
+}
+
+// openIndex opens the bleve index at path, read-only if readOnly is set
+// and that works.  A read-write open holds an exclusive lock until Close,
+// blocking any other open of the same index, so rather than wait it
+// fails with ErrIndexLocked if another process, or this one, has the
+// index.
+func openIndex(path string, readOnly bool) (bleve.Index, error) {
+	if err := checkIndexLock(path, readOnly); err != nil {
+		return nil, err
+	}
+	if readOnly {
+		index, err := bleve.OpenUsing(path, map[string]interface{}{"read_only": true})
+		if err == nil {
+			return holdIndex(index, path), nil
+		}
+		glog.Warningf("opening %v read-only failed, opening it read-write: %v", path, err)
+		if err := checkIndexLock(path, false); err != nil {
+			return nil, err
+		}
+	}
+	index, err := bleve.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return holdIndex(index, path), nil
+}
+
+// Close releases the bleve index and the TicketSource.
+func (d *Data) Close() error {
+	err := d.Index.Close()
+	if tsErr := d.ts.Close(); err == nil {
+		err = tsErr
+	}
+	if d.attachmentFile != nil {
+		if aErr := d.attachmentFile.Close(); err == nil {
+			err = aErr
+		}
+	}
+	return err
 }
 
-func (d *Data) Close() {
-	d.Index.Close()
+// ticketCountHint guesses how many tickets there are, to size what's
+// loaded for them: there's a bleve document for each ticket.  It's 0 if
+// there's no index, as when LoadIndex is called directly.
+func (d *Data) ticketCountHint() int {
+	if d.Index == nil {
+		return 0
+	}
+	n, err := d.Index.DocCount()
+	if err != nil {
+		return 0
+	}
+	return int(n)
 }
 
 func (d *Data) newIndex() error {
@@ -99,7 +314,7 @@ func (d *Data) newIndex() error {
 	defer fh.Close()
 	err = d.LoadIndex(fh)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("index.json: %w", err)
 	}
 	return nil
 }
@@ -107,184 +322,858 @@ func (d *Data) newIndex() error {
 // RTGitHubCSV returns the filename for the mapping of tickets from RT to GitHub
 const RTGitHubCSV = "rtgithub.csv"
 
-// RTGitHubCSV returns a io.ReadCloser pointing to the rtgithub.csv file
+// RTGitHubCSV returns a io.ReadCloser pointing to the rtgithub.csv file,
+// or whichever file Options.GitHubMap names.
 func (d *Data) RTGitHubCSV() (io.ReadCloser, error) {
-	return d.ts.GetFile(RTGitHubCSV)
+	return d.ts.GetFile(d.opts.GitHubMap.file())
+}
+
+// RTGitHubTSV reports whether the file from RTGitHubCSV is tab separated.
+func (d *Data) RTGitHubTSV() bool {
+	return strings.HasSuffix(d.opts.GitHubMap.file(), ".tsv")
 }
 
 func (d *Data) newRTGitHubMap() error {
-	d.rtGitHubMap = make(map[string]string)
-	fh, err := d.ts.GetFile(RTGitHubCSV)
+	// Usually most tickets were migrated.
+	d.rtGitHubMap = make(map[string]string, d.ticketCountHint())
+	fn := d.opts.GitHubMap.file()
+	fh, err := d.ts.GetFile(fn)
 	if errors.Is(err, os.ErrNotExist) {
 		// this map is optional, but definitely nice to have
+		glog.Warningf("no %v, GitHub links are disabled", fn)
 		return nil
 	}
 	if err != nil {
 		return err
 	}
 	defer fh.Close()
-	err = d.LoadRTGitHubMap(fh)
+	err = d.loadRTGitHubMap(fh, fn, d.opts.GitHubMap, d.RTGitHubTSV())
 	if err != nil {
-		// return err ?
-		log.Fatal(err)
+		// The map is optional, so keep whatever was read.
+		glog.Warningf("%v: %v", fn, err)
 	}
+	d.newGitHubRTMap()
 	return nil
 }
 
+// newGitHubRTMap builds gitHubRTMap from rtGitHubMap.  Where several RT
+// tickets map to one GitHub issue, the issue maps back to the lowest
+// numbered ticket.
+func (d *Data) newGitHubRTMap() {
+	d.gitHubRTMap = make(map[string]string, len(d.rtGitHubMap))
+	for rt, gh := range d.rtGitHubMap {
+		if prev, ok := d.gitHubRTMap[gh]; ok {
+			ip, _ := strconv.Atoi(prev)
+			ir, _ := strconv.Atoi(rt)
+			if ip < ir {
+				continue
+			}
+		}
+		d.gitHubRTMap[gh] = rt
+	}
+}
+
 func (d *Data) newMerged() error {
 	d.Merged = make(map[string]string)
 	fh, err := d.ts.GetJSON("merged")
 	if errors.Is(err, os.ErrNotExist) {
 		// this map is optional, but definitely nice to have
+		glog.Warning("no merged.json, merged tickets won't redirect")
 		return nil
 	}
 	if err != nil {
 		return err
 	}
 	defer fh.Close()
-	err = d.LoadMerged(fh)
-	if err != nil {
-		// return err ?
-		log.Fatal(err)
+	if err := d.LoadMerged(fh); err != nil {
+		return fmt.Errorf("merged.json: %w", err)
 	}
 	return nil
 }
 
+// IndexTicket is what's kept of a ticket from index.json.
 type IndexTicket struct {
-	ID           string `json:"Id"`
-	Status       string
-	Subject      string
-	Transactions []struct {
-		ID          string `json:"Id"`
-		Attachments []struct {
-			ID string `json:"Id"`
-		}
+	ID      string `json:"Id"`
+	Status  string
+	Subject string
+}
+
+// indexEntry is a ticket as it appears in index.json.  The transactions
+// are only needed to find the attachments while loading, so they aren't
+// kept.
+type indexEntry struct {
+	IndexTicket
+	Transactions []indexTransaction
+}
+
+type indexTransaction struct {
+	ID          string `json:"Id"`
+	Attachments []struct {
+		ID string `json:"Id"`
 	}
 }
 
-type AttachmentMeta struct {
-	TicketID string
-	// We could recompute the Offsets from the Ticket but storing them
-	// saves a little time.
-	TransactionOffset int
-	AttachmentOffset  int
+// reset empties e for decoding the next ticket into, keeping the
+// Transactions array to save reallocating it for every ticket.  The
+// decoder doesn't clear elements it reuses, so they're zeroed here.
+func (e *indexEntry) reset() {
+	tr := e.Transactions[:cap(e.Transactions)]
+	for i := range tr {
+		tr[i] = indexTransaction{}
+	}
+	*e = indexEntry{Transactions: tr[:0]}
 }
 
-func (d *Data) processIndexTicket(t *IndexTicket) error {
+func (d *Data) processIndexTicket(e *indexEntry) error {
+	t := &IndexTicket{}
+	*t = e.IndexTicket
 	d.ticketIndex = append(d.ticketIndex, t)
+	d.ticketsByID[t.ID] = t
+	d.statuses[t.Status]++
 
-	for trOff, tr := range t.Transactions {
-		for attOff, att := range tr.Attachments {
-			d.attachmentMetaMap[att.ID] = AttachmentMeta{
-				TicketID:          t.ID,
-				TransactionOffset: trOff,
-				AttachmentOffset:  attOff,
-			}
+	// Only the ticket is recorded; the attachment's position in the
+	// ticket is found when it's requested.  Most attachments never are,
+	// and this map covers every attachment in the archive.
+	for _, tr := range e.Transactions {
+		for _, att := range tr.Attachments {
+			d.addAttachment(att.ID, t.ID)
+		}
+	}
+	return nil
+}
+
+// addAttachment records that attachment att belongs to ticket.  For an
+// AttachmentFile the pair is kept for finishAttachments to write, unless
+// the ids aren't plain numbers, which sends everything back to the map.
+func (d *Data) addAttachment(att, ticket string) {
+	if d.opts.AttachmentFile != "" && d.attachmentPairs != nil {
+		a, aOK := parseID(att)
+		t, tOK := parseID(ticket)
+		if aOK && tOK {
+			d.attachmentPairs = append(d.attachmentPairs, attachmentPair{a, t})
+			return
+		}
+		glog.Warningf("attachment %q of ticket %q isn't numbered, keeping attachments in memory", att, ticket)
+		for _, p := range d.attachmentPairs {
+			d.attachmentTickets[strconv.FormatUint(p.attachment, 10)] = strconv.FormatUint(p.ticket, 10)
 		}
+		d.attachmentPairs = nil
+	}
+	d.attachmentTickets[att] = ticket
+}
+
+// finishAttachments writes the AttachmentFile, if there is one.
+func (d *Data) finishAttachments() error {
+	pairs := d.attachmentPairs
+	d.attachmentPairs = nil
+	if pairs == nil {
+		return nil
+	}
+	af, err := writeAttachmentFile(d.opts.AttachmentFile, pairs)
+	if err != nil {
+		return fmt.Errorf("%v: %w", d.opts.AttachmentFile, err)
+	}
+	if d.attachmentFile != nil {
+		d.attachmentFile.Close()
 	}
+	d.attachmentFile = af
 	return nil
 }
 
-// LoadRTGitHubMap loads the mapping of old ids to the new ones.
+// attachmentTicket returns the ticket attachment id belongs to.
+func (d *Data) attachmentTicket(id string) (string, bool) {
+	if d.attachmentFile != nil {
+		return d.attachmentFile.get(id)
+	}
+	t, ok := d.attachmentTickets[id]
+	return t, ok
+}
+
+func (d *Data) attachmentCount() int {
+	if d.attachmentFile != nil {
+		return d.attachmentFile.n
+	}
+	return len(d.attachmentTickets)
+}
+
+// LoadRTGitHubMap loads CSV rows of RT id, GitHub issue.  A header row,
+// and rows that are malformed or too short, are skipped and logged rather
+// than failing the whole map.
 func (d *Data) LoadRTGitHubMap(fh io.Reader) error {
+	if d.rtGitHubMap == nil {
+		d.rtGitHubMap = make(map[string]string)
+	}
+	err := d.loadRTGitHubMap(fh, RTGitHubCSV, GitHubMapOptions{}, false)
+	d.newGitHubRTMap()
+	return err
+}
+
+// column returns the index of the column spec names, looking names up in
+// header.
+func column(spec, def string, header []string) (int, error) {
+	if spec == "" {
+		spec = def
+	}
+	if n, err := strconv.Atoi(spec); err == nil {
+		return n, nil
+	}
+	for i, h := range header {
+		if strings.EqualFold(strings.TrimSpace(h), spec) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no column %q in header %q", spec, header)
+}
+
+// gitHubMapReader returns a reader for the rows of a GitHub map.
+func gitHubMapReader(fh io.Reader, tsv bool) *csv.Reader {
 	c := csv.NewReader(fh)
-	rs, err := c.ReadAll()
-	if err != nil {
-		return err
+	c.FieldsPerRecord = -1 // checked by the callers
+	c.ReuseRecord = true   // the strings are copied out, not the slice
+	if tsv {
+		c.Comma = '\t'
+		c.LazyQuotes = true // TSV doesn't quote
 	}
-	for _, row := range rs {
-		d.rtGitHubMap[row[0]] = row[1]
+	return c
+}
+
+func (d *Data) loadRTGitHubMap(fh io.Reader, fn string, opts GitHubMapOptions, tsv bool) error {
+	c := gitHubMapReader(fh, tsv)
+
+	var key, val int
+	resolved := false // the columns come from the first row that parses
+	skipped := 0
+	for {
+		row, err := c.Read()
+		if err == io.EOF {
+			break
+		}
+		var pe *csv.ParseError
+		if errors.As(err, &pe) {
+			glog.Warningf("%v: skipping %v", fn, err)
+			skipped++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		first := !resolved
+		if first {
+			var kErr, vErr error
+			key, kErr = column(opts.Key, "0", row)
+			val, vErr = column(opts.Value, "1", row)
+			if kErr != nil {
+				return kErr
+			}
+			if vErr != nil {
+				return vErr
+			}
+			resolved = true
+		}
+		if len(row) <= key || len(row) <= val {
+			line, _ := c.FieldPos(0)
+			glog.Warningf("%v: skipping line %d, only %d columns", fn, line, len(row))
+			skipped++
+			continue
+		}
+		if _, err := strconv.Atoi(row[key]); first && err != nil {
+			continue // header
+		}
+		d.rtGitHubMap[row[key]] = row[val]
+	}
+	if skipped > 0 {
+		glog.Warningf("%v: skipped %d malformed rows", fn, skipped)
 	}
 	return nil
 }
 
+// FilterRTGitHubCSV copies fh, the file from RTGitHubCSV, to w, leaving
+// out the rows of RT tickets keep returns false for.  A header row is
+// kept, and rows LoadRTGitHubMap would skip are left out.
+func (d *Data) FilterRTGitHubCSV(w io.Writer, fh io.Reader, keep func(rtID string) bool) error {
+	tsv := d.RTGitHubTSV()
+	c := gitHubMapReader(fh, tsv)
+	cw := csv.NewWriter(w)
+	if tsv {
+		cw.Comma = '\t'
+	}
+	key := 0
+	resolved := false
+	for {
+		row, err := c.Read()
+		if err == io.EOF {
+			break
+		}
+		var pe *csv.ParseError
+		if errors.As(err, &pe) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		first := !resolved
+		if first {
+			key, err = column(d.opts.GitHubMap.Key, "0", row)
+			if err != nil {
+				return err
+			}
+			resolved = true
+		}
+		if len(row) <= key {
+			continue
+		}
+		_, err = strconv.Atoi(row[key])
+		header := first && err != nil
+		if !header && !keep(row[key]) {
+			continue
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
 func (d *Data) LoadMerged(fh io.Reader) error {
 	j := json.NewDecoder(fh)
 	return j.Decode(&d.Merged)
 }
 
-// LoadIndex loads an index.json file.
+// utf8BOM is sometimes written at the start of JSON files by other tools.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// LoadIndex loads an index.json file.  It may either be a JSON array of
+// IndexTickets, or (from newer exporters) an object of IndexTickets keyed
+// by ticket id.  Elements are decoded one at a time, so the whole file is
+// never in memory at once.
 func (d *Data) LoadIndex(fh io.Reader) error {
-	j := json.NewDecoder(fh)
+	br := bufio.NewReader(fh)
+	if b, err := br.Peek(len(utf8BOM)); err == nil && bytes.Equal(b, utf8BOM) {
+		br.Discard(len(utf8BOM))
+	}
+	j := json.NewDecoder(br)
 
-	// read open bracket so the array elements are next
-	_, err := j.Token()
+	// read the opening delimiter so the elements are next
+	tok, err := j.Token()
+	if err == io.EOF {
+		return errors.New("empty index")
+	}
 	if err != nil {
 		return err
 	}
 
-	d.attachmentMetaMap = make(map[string]AttachmentMeta)
+	// Every ticket has at least one attachment, its first message.
+	n := d.ticketCountHint()
+	d.ticketIndex = make([]*IndexTicket, 0, n)
+	if d.opts.AttachmentFile != "" {
+		d.attachmentTickets = make(map[string]string)
+		d.attachmentPairs = make([]attachmentPair, 0, n)
+	} else {
+		d.attachmentTickets = make(map[string]string, n)
+	}
+	d.ticketsByID = make(map[string]*IndexTicket, n)
+	d.statuses = make(map[string]int)
+
+	switch tok {
+	case json.Delim('['):
+		err = d.loadIndexArray(j)
+	case json.Delim('{'):
+		err = d.loadIndexObject(j)
+	default:
+		return fmt.Errorf("expected an array or object, found %v", tok)
+	}
+	if err != nil {
+		return err
+	}
+
+	// read closing delimiter
+	_, err = j.Token()
+	if err != nil {
+		return err
+	}
+
+	// Anything else means the file isn't what we think it is.
+	if tok, err := j.Token(); err != io.EOF {
+		if err != nil {
+			return fmt.Errorf("after index: %w", err)
+		}
+		return fmt.Errorf("unexpected %v after index", tok)
+	}
+	return d.finishAttachments()
+}
+
+func (d *Data) loadIndexArray(j *json.Decoder) error {
+	var e indexEntry
+	for n := 0; j.More(); n++ {
+		e.reset()
+		err := j.Decode(&e)
+		if err != nil {
+			return fmt.Errorf("ticket %d: %w", n, err)
+		}
+		err = d.processIndexTicket(&e)
+		if err != nil {
+			return fmt.Errorf("ticket %d (%v): %w", n, e.ID, err)
+		}
+	}
+	return nil
+}
 
+func (d *Data) loadIndexObject(j *json.Decoder) error {
+	var e indexEntry
 	for j.More() {
-		var t IndexTicket
-		err := j.Decode(&t)
+		tok, err := j.Token()
 		if err != nil {
 			return err
 		}
-		err = d.processIndexTicket(&t)
+		key, _ := tok.(string) // object keys are always strings
+
+		e.reset()
+		err = j.Decode(&e)
 		if err != nil {
-			return err
+			return fmt.Errorf("ticket %v: %w", key, err)
+		}
+		if e.ID == "" {
+			e.ID = key
+		}
+		if e.ID != key {
+			return fmt.Errorf("ticket %v has id %v", key, e.ID)
+		}
+		err = d.processIndexTicket(&e)
+		if err != nil {
+			return fmt.Errorf("ticket %v: %w", key, err)
 		}
 	}
-	// read closing bracket
-	_, err = j.Token()
+
+	// Object order isn't meaningful, but the array form is sorted by id
+	// and that's what everything else expects.
+	sort.SliceStable(d.ticketIndex, func(a, b int) bool {
+		ia, _ := strconv.Atoi(d.ticketIndex[a].ID)
+		ib, _ := strconv.Atoi(d.ticketIndex[b].ID)
+		return ia < ib
+	})
+	return nil
+}
+
+// SearchOnly reports whether d was opened with Options.SearchOnly.
+func (d *Data) SearchOnly() bool {
+	return d.opts.SearchOnly
+}
+
+// TicketIDs returns the ids of the tickets in index.json, in numeric
+// order.
+func (d *Data) TicketIDs() []string {
+	ids := make([]string, len(d.ticketIndex))
+	for i, t := range d.ticketIndex {
+		ids[i] = t.ID
+	}
+	return ids
+}
+
+// SourceTicketIDs returns the ids of the ticket files in the data
+// directories and zips, in numeric order, whether or not index.json lists
+// them.
+func (d *Data) SourceTicketIDs() ([]string, error) {
+	ids, err := d.ts.TicketIDs()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	sortIDs(ids)
+	return ids, nil
+}
+
+// IndexedIDs returns the ids of the documents in the bleve index, in
+// numeric order.
+func (d *Data) IndexedIDs() ([]string, error) {
+	i, _, err := d.Index.Advanced()
+	if err != nil {
+		return nil, err
+	}
+	r, err := i.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	dr, err := r.DocIDReaderAll()
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+
+	var ids []string
+	for {
+		iid, err := dr.Next()
+		if err != nil {
+			return nil, err
+		}
+		if iid == nil {
+			break
+		}
+		id, err := r.ExternalID(iid)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	sortIDs(ids)
+	return ids, nil
+}
+
+// sortIDs sorts ticket ids numerically.
+func sortIDs(ids []string) {
+	sort.SliceStable(ids, func(a, b int) bool {
+		ia, _ := strconv.Atoi(ids[a])
+		ib, _ := strconv.Atoi(ids[b])
+		return ia < ib
+	})
+}
+
+// TicketsWithPrefix returns up to max tickets from index.json whose ids
+// start with the digits prefix, in numeric order, and whether there were
+// more.  The ids starting with 12 are 12, 120-129, 1200-1299 and so on,
+// each a range of the sorted ticketIndex found by binary search.
+func (d *Data) TicketsWithPrefix(prefix string, max int) ([]*IndexTicket, bool) {
+	lo, err := strconv.Atoi(prefix)
+	if err != nil || lo <= 0 || strings.HasPrefix(prefix, "0") {
+		return nil, false
+	}
+	n := len(d.ticketIndex)
+	if n == 0 {
+		return nil, false
+	}
+	last, _ := strconv.Atoi(d.ticketIndex[n-1].ID)
+	num := func(i int) int {
+		id, _ := strconv.Atoi(d.ticketIndex[i].ID)
+		return id
+	}
+
+	var found []*IndexTicket
+	for hi := lo + 1; lo <= last; lo, hi = lo*10, hi*10 {
+		i := sort.Search(n, func(i int) bool { return num(i) >= lo })
+		for ; i < n && num(i) < hi; i++ {
+			if len(found) == max {
+				return found, true
+			}
+			found = append(found, d.ticketIndex[i])
+		}
+	}
+	return found, false
+}
+
+// IsIndexed reports whether the ticket id is part of index.json.
+func (d *Data) IsIndexed(id string) bool {
+	_, ok := d.ticketsByID[id]
+	return ok
+}
+
+// TicketStatus returns the status of ticket id from index.json, and
+// whether the ticket is listed there.
+func (d *Data) TicketStatus(id string) (string, bool) {
+	t, ok := d.ticketsByID[id]
+	if !ok {
+		return "", false
+	}
+	return t.Status, true
+}
+
+// AttachmentTicket returns the id of the ticket attachment id belongs to,
+// and whether it's known.
+func (d *Data) AttachmentTicket(id string) (string, bool) {
+	return d.attachmentTicket(id)
+}
+
+// Statuses returns the statuses used by tickets in index.json, sorted.
+func (d *Data) Statuses() []string {
+	var sts []string
+	for st := range d.statuses {
+		sts = append(sts, st)
+	}
+	sort.Strings(sts)
+	return sts
+}
+
+// SimilarTickets returns up to n tickets with subjects resembling the
+// subject of ticket id, most similar first.
+func (d *Data) SimilarTickets(ctx context.Context, id string, n int) ([]*IndexTicket, error) {
+	t, ok := d.ticketsByID[id]
+	if !ok || strings.TrimSpace(t.Subject) == "" {
+		return nil, nil
+	}
+
+	// A match query analyzes the subject the same way it was indexed and
+	// ORs the resulting terms together, so tickets sharing more (and
+	// rarer) terms score higher.
+	mq := bleve.NewMatchQuery(t.Subject)
+	mq.SetField("subject")
+	q := bleve.NewBooleanQuery()
+	q.AddMust(mq)
+	q.AddMustNot(bleve.NewDocIDQuery([]string{id}))
+
+	sr := bleve.NewSearchRequestOptions(q, n, 0, false)
+	res, err := d.Index.SearchInContext(ctx, sr)
+	if err != nil {
+		return nil, err
+	}
+
+	var similar []*IndexTicket
+	for _, h := range res.Hits {
+		if st, ok := d.ticketsByID[h.ID]; ok {
+			similar = append(similar, st)
+		}
+	}
+	return similar, nil
 }
 
 func (d *Data) GetTicket(id string) (interface{}, error) {
+	if d.opts.SearchOnly {
+		return nil, &Error{ErrSearchOnly, id, nil}
+	}
 	t, err := d.ts.GetTicket(id)
 	if err != nil {
-		return t, err
+		return nil, ticketError(id, err)
 	}
 	// use reflection to add a GitHubIssue field.  Ticket should really be a proper type.
-	g, _ := d.rtGitHubMap[id] // throw away ok, because we want the default value of "" if not found.
+	g, _ := d.GitHubIssue(id) // throw away ok, because we want the default value of "" if not found.
 	v := reflect.ValueOf(t)
+	if v.Kind() != reflect.Map {
+		return nil, &Error{ErrCorruptTicket, id, fmt.Errorf("expected an object, found %T", t)}
+	}
 	v.SetMapIndex(reflect.ValueOf("GitHubIssue"), reflect.ValueOf(g))
 
 	return t, nil
 }
 
-// GetAttachment returns the filename, content-type, and bytes of an attachment.
-func (d *Data) GetAttachment(id string) (string, string, []byte, error) {
-	attMeta, ok := d.attachmentMetaMap[id]
-	if !ok {
-		return "", "", nil, fmt.Errorf("can't find metadata for attachment %v", id)
+// GitHubIssue returns the GitHub issue ticket id was migrated to, and
+// whether there is one.
+func (d *Data) GitHubIssue(id string) (string, bool) {
+	g, ok := d.rtGitHubMap[id]
+	return g, ok
+}
+
+// RTTicket returns the lowest numbered RT ticket migrated to GitHub
+// issue n, and whether there is one.
+func (d *Data) RTTicket(n string) (string, bool) {
+	id, ok := d.gitHubRTMap[n]
+	return id, ok
+}
+
+// RawTicket returns a ticket's JSON exactly as the TicketSource has it,
+// without GitHubIssue or anything else added.
+func (d *Data) RawTicket(id string) (io.ReadCloser, error) {
+	if d.opts.SearchOnly {
+		return nil, &Error{ErrSearchOnly, id, nil}
 	}
+	r, err := d.ts.GetJSON(id)
+	if err != nil {
+		return nil, ticketError(id, err)
+	}
+	return r, nil
+}
+
+// Attachment describes an attachment, without its content.
+type Attachment struct {
+	ID            string
+	TransactionID string
+	Filename      string
+	ContentType   string
+	Size          int // decoded size in bytes
+}
 
-	tick, err := d.GetTicket(attMeta.TicketID)
+// RawAttachment is an attachment as it's stored in its ticket, with the
+// content not yet decoded.
+type RawAttachment struct {
+	Attachment
+	content string
+}
+
+// Content decodes the attachment's content.
+func (a RawAttachment) Content() ([]byte, error) {
+	b, err := decodeContent(a.ContentType, a.content)
 	if err != nil {
-		return "", "", nil, fmt.Errorf("getTIcket(%v): %v", attMeta.TicketID, err)
+		return nil, &Error{ErrCorruptTicket, a.ID, err}
 	}
+	return b, nil
+}
 
-	glog.Infof("Ticket: %q", attMeta.TicketID)
-	toff := attMeta.TransactionOffset
-	aoff := attMeta.AttachmentOffset
+// newRawAttachment makes a RawAttachment from the ticket JSON records of
+// an attachment and the transaction it belongs to.
+func newRawAttachment(tr, a map[string]interface{}) RawAttachment {
+	filename, _ := a["Filename"].(string)
+	contentType, _ := a["ContentType"].(string)
+	content, _ := a["OriginalContent"].(string)
+	return RawAttachment{
+		Attachment: Attachment{
+			ID:            fmt.Sprint(a["id"]),
+			TransactionID: fmt.Sprint(tr["id"]),
+			Filename:      filename,
+			ContentType:   contentType,
+			Size:          contentSize(contentType, content),
+		},
+		content: content,
+	}
+}
 
-	t := tick.(map[string]interface{})
-	ts := t["Transactions"].([]interface{})
-	tr := ts[int(toff)].(map[string]interface{})
-	atts := tr["Attachments"].([]interface{})
-	att := atts[int(aoff)].(map[string]interface{})
+// ListAttachments returns the metadata for the named attachments (those
+// with a filename, as opposed to message bodies) of a ticket.  The
+// content is never decoded.
+func (d *Data) ListAttachments(ticketID string) ([]Attachment, error) {
+	raw, err := d.namedAttachments(ticketID)
+	return attachmentList(raw), err
+}
 
-	contentType := att["ContentType"].(string)
-	filename := att["Filename"].(string)
+// TicketAttachments is ListAttachments for a ticket already returned by
+// GetTicket, so it isn't read again.
+func TicketAttachments(tick interface{}) []Attachment {
+	return attachmentList(ticketAttachments(tick))
+}
 
-	glog.Infof("Filename: %q", att["Filename"].(string))
-	glog.Infof("Content Type: %q", att["ContentType"].(string))
+// attachmentList returns the metadata of raw.
+func attachmentList(raw []RawAttachment) []Attachment {
+	var atts []Attachment
+	for _, a := range raw {
+		atts = append(atts, a.Attachment)
+	}
+	return atts
+}
 
-	originalContent := att["OriginalContent"].(string)
-	var content []byte
-	if strings.HasPrefix(contentType, "text/") {
-		content = []byte(originalContent)
-	} else {
-		content, err = base64.StdEncoding.DecodeString(originalContent)
+// WalkAttachments calls fn with each named attachment of tick, a ticket
+// from GetTicket, and its decoded content, stopping at the first error.
+// Only one attachment is decoded at a time.  If skip is non-nil,
+// attachments it returns true for aren't decoded or passed to fn.
+func WalkAttachments(tick interface{}, skip func(Attachment) bool, fn func(Attachment, []byte) error) error {
+	for _, a := range ticketAttachments(tick) {
+		if skip != nil && skip(a.Attachment) {
+			continue
+		}
+		b, err := a.Content()
+		if err != nil {
+			return err
+		}
+		err = fn(a.Attachment, b)
 		if err != nil {
-			return "", "", nil, fmt.Errorf("can't decode attachment: %v", err)
+			return err
 		}
 	}
+	return nil
+}
+
+// namedAttachments returns a ticket's named attachments.
+func (d *Data) namedAttachments(ticketID string) ([]RawAttachment, error) {
+	tick, err := d.GetTicket(ticketID)
+	if err != nil {
+		return nil, err
+	}
+	return ticketAttachments(tick), nil
+}
+
+// ticketAttachments returns the named attachments of tick, a ticket from
+// GetTicket.
+func ticketAttachments(tick interface{}) []RawAttachment {
+	var raw []RawAttachment
+	t, _ := tick.(map[string]interface{})
+	ts, _ := t["Transactions"].([]interface{})
+	for _, trI := range ts {
+		tr, _ := trI.(map[string]interface{})
+		as, _ := tr["Attachments"].([]interface{})
+		for _, aI := range as {
+			a, _ := aI.(map[string]interface{})
+			if filename, _ := a["Filename"].(string); filename == "" {
+				continue
+			}
+			raw = append(raw, newRawAttachment(tr, a))
+		}
+	}
+	return raw
+}
+
+// decodeContent returns the bytes of an attachment.  Text is stored as
+// is, everything else is base64 encoded.
+func decodeContent(contentType, content string) ([]byte, error) {
+	if strings.HasPrefix(contentType, "text/") {
+		return []byte(content), nil
+	}
+	b, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		return nil, fmt.Errorf("can't decode attachment: %v", err)
+	}
+	return b, nil
+}
+
+// contentSize returns the size of an attachment's content once decoded,
+// without decoding it.
+func contentSize(contentType, content string) int {
+	if strings.HasPrefix(contentType, "text/") {
+		return len(content)
+	}
+	// base64, possibly with line breaks.
+	n, pad := 0, 0
+	for _, c := range content {
+		switch c {
+		case '\n', '\r', ' ', '\t':
+			continue
+		case '=':
+			pad++
+		}
+		n++
+	}
+	return n/4*3 - pad
+}
+
+// FindAttachment returns attachment id from the ticket it belongs to,
+// which is read once, for callers that want both its metadata and its
+// content.
+func (d *Data) FindAttachment(id string) (RawAttachment, error) {
+	if d.opts.SearchOnly {
+		return RawAttachment{}, &Error{ErrSearchOnly, id, nil}
+	}
+	ticketID, ok := d.attachmentTicket(id)
+	if !ok {
+		return RawAttachment{}, &Error{ErrAttachmentNotFound, id, nil}
+	}
+
+	tick, err := d.GetTicket(ticketID)
+	if err != nil {
+		return RawAttachment{}, fmt.Errorf("attachment %v: %w", id, err)
+	}
+
+	glog.Infof("Ticket: %q", ticketID)
+
+	t, _ := tick.(map[string]interface{})
+	ts, _ := t["Transactions"].([]interface{})
+	for _, trI := range ts {
+		tr, _ := trI.(map[string]interface{})
+		atts, _ := tr["Attachments"].([]interface{})
+		for _, aI := range atts {
+			att, _ := aI.(map[string]interface{})
+			if fmt.Sprint(att["id"]) == id {
+				return newRawAttachment(tr, att), nil
+			}
+		}
+	}
+	return RawAttachment{}, &Error{ErrAttachmentNotFound, id, fmt.Errorf("not in ticket %v", ticketID)}
+}
+
+// HasAttachment reports whether attachment id can be retrieved, that is
+// whether the index knows which ticket it belongs to.
+func (d *Data) HasAttachment(id string) bool {
+	_, ok := d.attachmentTicket(id)
+	return ok
+}
+
+// GetAttachment returns the filename, content-type, and bytes of an attachment.
+func (d *Data) GetAttachment(id string) (string, string, []byte, error) {
+	att, err := d.FindAttachment(id)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	glog.Infof("Filename: %q", att.Filename)
+	glog.Infof("Content Type: %q", att.ContentType)
+
+	content, err := att.Content()
+	if err != nil {
+		return "", "", nil, err
+	}
 
-	return filename, contentType, content, nil
+	return att.Filename, att.ContentType, content, nil
 }
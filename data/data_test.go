@@ -0,0 +1,517 @@
+package data
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+)
+
+// memSource is a TicketSource holding its files in memory.
+type memSource map[string][]byte
+
+func (m memSource) GetFile(name string) (io.ReadCloser, error) {
+	b, ok := m[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", os.ErrNotExist, name)
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (m memSource) GetJSON(id string) (io.ReadCloser, error) {
+	return m.GetFile(id + ".json")
+}
+
+func (m memSource) GetTicket(id string) (interface{}, error) {
+	b, ok := m[id+".json"]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v.json", os.ErrNotExist, id)
+	}
+	var t interface{}
+	err := json.Unmarshal(b, &t)
+	return t, err
+}
+
+func (m memSource) TicketIDs() ([]string, error) {
+	var ids []string
+	for name := range m {
+		id := strings.TrimSuffix(name, ".json")
+		if _, err := strconv.Atoi(id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (m memSource) Close() error { return nil }
+
+// testTicket returns the JSON of ticket id with transactions, each with
+// attachments named attachments.  Attachment ids are id*1000 + n, counting
+// across the ticket, and transaction ids id*100 + n.
+func testTicket(id, transactions, attachments int) []byte {
+	var trs []interface{}
+	n := 0
+	for i := 0; i < transactions; i++ {
+		var atts []interface{}
+		for j := 0; j < attachments; j++ {
+			atts = append(atts, map[string]interface{}{
+				"id":              strconv.Itoa(id*1000 + n),
+				"Filename":        fmt.Sprintf("f%d.txt", n),
+				"ContentType":     "text/plain",
+				"OriginalContent": fmt.Sprintf("attachment %d of ticket %d", n, id),
+			})
+			n++
+		}
+		trs = append(trs, map[string]interface{}{
+			"id":          strconv.Itoa(id*100 + i),
+			"Type":        "Correspond",
+			"Attachments": atts,
+		})
+	}
+	b, _ := json.Marshal(map[string]interface{}{
+		"Id":           strconv.Itoa(id),
+		"Status":       "open",
+		"Subject":      fmt.Sprintf("ticket %d", id),
+		"Transactions": trs,
+	})
+	return b
+}
+
+func TestLoadIndex(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string // ticket ids, in order
+		wantErr bool
+	}{
+		{"array", `[{"Id": "1", "Status": "open"}, {"Id": "12", "Status": "resolved"}]`, "1,12", false},
+		{"empty array", `[]`, "", false},
+		{"whitespace", " \n[ {\"Id\": \"3\"} ]\n", "3", false},
+		{"byte order mark", "\xef\xbb\xbf[{\"Id\": \"3\"}]", "3", false},
+		{"object", `{"12": {"Id": "12"}, "2": {"Status": "open"}}`, "2,12", false},
+		{"empty object", `{}`, "", false},
+		{"object id mismatch", `{"12": {"Id": "13"}}`, "", true},
+		{"empty", ``, "", true},
+		{"scalar", `42`, "", true},
+		{"trailing garbage", `[{"Id": "1"}] x`, "", true},
+		{"trailing array", `[{"Id": "1"}][]`, "", true},
+		{"truncated", `[{"Id": "1"}, {"Id": `, "", true},
+		{"unterminated", `[{"Id": "1"}`, "", true},
+		{"not a ticket", `["1"]`, "", true},
+		{"bad field", `[{"Id": 1}]`, "", true},
+	}
+	for _, tc := range tests {
+		d := &Data{}
+		err := d.LoadIndex(strings.NewReader(tc.in))
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%v: LoadIndex(%q) error = %v, want error %v", tc.name, tc.in, err, tc.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := strings.Join(d.TicketIDs(), ","); got != tc.want {
+			t.Errorf("%v: LoadIndex(%q) loaded %q, want %q", tc.name, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestLoadIndexAttachments(t *testing.T) {
+	d := &Data{}
+	in := `[{"Id": "1", "Transactions": [{"Id": "10", "Attachments": [{"Id": "100"}, {"Id": "101"}]}]},
+		{"Id": "2", "Transactions": [{"Id": "20", "Attachments": [{"Id": "200"}]}]}]`
+	if err := d.LoadIndex(strings.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+	for att, want := range map[string]string{"100": "1", "101": "1", "200": "2"} {
+		if got := d.attachmentTickets[att]; got != want {
+			t.Errorf("attachment %v is in ticket %q, want %q", att, got, want)
+		}
+	}
+}
+
+func TestAttachmentFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     string
+		inFile bool              // whether the map went to the file
+		want   map[string]string // attachment → ticket, "" for none
+	}{
+		{"numbers", `[{"Id": "1", "Transactions": [{"Attachments": [{"Id": "100"}, {"Id": "101"}]}]},
+			{"Id": "2", "Transactions": [{"Attachments": [{"Id": "200"}]}]}]`,
+			true, map[string]string{"100": "1", "101": "1", "200": "2", "0100": "", "102": ""}},
+		{"leading zero attachment", `[{"Id": "1", "Transactions": [{"Attachments": [{"Id": "100"}, {"Id": "0123"}]}]}]`,
+			false, map[string]string{"100": "1", "0123": "1", "123": ""}},
+		{"leading zero ticket", `[{"Id": "01", "Transactions": [{"Attachments": [{"Id": "100"}]}]},
+			{"Id": "2", "Transactions": [{"Attachments": [{"Id": "200"}]}]}]`,
+			false, map[string]string{"100": "01", "200": "2"}},
+		{"not numbers", `[{"Id": "1", "Transactions": [{"Attachments": [{"Id": "100"}, {"Id": "a1"}]}]}]`,
+			false, map[string]string{"100": "1", "a1": "1"}},
+	}
+	for _, tc := range tests {
+		d := &Data{opts: Options{AttachmentFile: filepath.Join(t.TempDir(), "attachments.bin")}}
+		if err := d.LoadIndex(strings.NewReader(tc.in)); err != nil {
+			t.Errorf("%v: LoadIndex: %v", tc.name, err)
+			continue
+		}
+		if got := d.attachmentFile != nil; got != tc.inFile {
+			t.Errorf("%v: attachments in a file %v, want %v", tc.name, got, tc.inFile)
+		}
+		for att, want := range tc.want {
+			if got, ok := d.attachmentTicket(att); got != want || ok != (want != "") {
+				t.Errorf("%v: attachment %v is in ticket %q, %v, want %q", tc.name, att, got, ok, want)
+			}
+		}
+		if d.attachmentFile != nil {
+			d.attachmentFile.Close()
+		}
+	}
+}
+
+func TestNewMerged(t *testing.T) {
+	d := &Data{ts: memSource{"merged.json": []byte(`{"4": "1"}`)}}
+	if err := d.newMerged(); err != nil || d.Merged["4"] != "1" {
+		t.Errorf("newMerged: %v, loaded %v", err, d.Merged)
+	}
+	d = &Data{ts: memSource{}}
+	if err := d.newMerged(); err != nil {
+		t.Errorf("newMerged without merged.json: %v", err)
+	}
+	// A reload with a broken merged.json fails rather than exiting.
+	d = &Data{ts: memSource{"merged.json": []byte(`{"4": `)}}
+	if err := d.newMerged(); err == nil {
+		t.Errorf("newMerged with broken JSON: got no error, want one")
+	}
+}
+
+func TestLoadRTGitHubMap(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want map[string]string // RT id → GitHub issue
+	}{
+		{"plain", "1,101\n2,102\n", map[string]string{"1": "101", "2": "102"}},
+		{"header", "rt,github\n1,101\n2,102\n", map[string]string{"1": "101", "2": "102"}},
+		{"short rows", "1,101\n2\n\n3,103\n", map[string]string{"1": "101", "3": "103"}},
+		{"short header", "rt\n1,101\n", map[string]string{"1": "101"}},
+		{"extra columns", "1,101,x\n2,102\n", map[string]string{"1": "101", "2": "102"}},
+		{"bad quoting", "1,101\n2,\"10\"2\"\n3,103\n", map[string]string{"1": "101", "3": "103"}},
+		{"bad first line", "r\"t,github\n1,101\n2,102\n", map[string]string{"1": "101", "2": "102"}},
+		{"empty", "", map[string]string{}},
+	}
+	for _, tc := range tests {
+		d := &Data{}
+		if err := d.LoadRTGitHubMap(strings.NewReader(tc.in)); err != nil {
+			t.Errorf("%v: LoadRTGitHubMap: %v", tc.name, err)
+			continue
+		}
+		if len(d.rtGitHubMap) != len(tc.want) {
+			t.Errorf("%v: loaded %v, want %v", tc.name, d.rtGitHubMap, tc.want)
+			continue
+		}
+		for rt, gh := range tc.want {
+			if got, ok := d.GitHubIssue(rt); !ok || got != gh {
+				t.Errorf("%v: GitHubIssue(%v) = %q, %v, want %q", tc.name, rt, got, ok, gh)
+			}
+			if got, ok := d.RTTicket(gh); !ok || got != rt {
+				t.Errorf("%v: RTTicket(%v) = %q, %v, want %q", tc.name, gh, got, ok, rt)
+			}
+		}
+	}
+}
+
+func TestLoadRTGitHubMapColumns(t *testing.T) {
+	d := &Data{rtGitHubMap: make(map[string]string)}
+	in := "issue\tticket\ttitle\n101\t1\tfirst\n102\n103\t3\tthird\n"
+	opts := GitHubMapOptions{Key: "Ticket", Value: "issue"}
+	if err := d.loadRTGitHubMap(strings.NewReader(in), "map.tsv", opts, true); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"1": "101", "3": "103"}
+	if len(d.rtGitHubMap) != len(want) || d.rtGitHubMap["1"] != "101" || d.rtGitHubMap["3"] != "103" {
+		t.Errorf("loaded %v, want %v", d.rtGitHubMap, want)
+	}
+
+	// The header is the first row that parses, not the first line.
+	d = &Data{rtGitHubMap: make(map[string]string)}
+	in = "x\"y,z\nissue,ticket\n101,1\n102,2\n"
+	if err := d.loadRTGitHubMap(strings.NewReader(in), "map.csv", opts, false); err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]string{"1": "101", "2": "102"}
+	if len(d.rtGitHubMap) != len(want) || d.rtGitHubMap["1"] != "101" || d.rtGitHubMap["2"] != "102" {
+		t.Errorf("after a malformed first line, loaded %v, want %v", d.rtGitHubMap, want)
+	}
+
+	// A named column needs a header to find it in.
+	d = &Data{rtGitHubMap: make(map[string]string)}
+	opts = GitHubMapOptions{Key: "ticket", Value: "issue"}
+	if err := d.loadRTGitHubMap(strings.NewReader("101\t1\n"), "map.tsv", opts, true); err == nil {
+		t.Errorf("loadRTGitHubMap with no header: got no error, want one")
+	}
+}
+
+// attachmentMeta is how attachments used to be found: the ticket, and
+// the position of the attachment in it.
+type attachmentMeta struct {
+	TicketID          string
+	TransactionOffset int
+	AttachmentOffset  int
+}
+
+const (
+	benchTickets      = 10000
+	benchTransactions = 10
+	benchAttachments  = 2
+)
+
+// The map from attachments to tickets covers every attachment in the
+// archive and is kept for as long as the server runs.  Without the
+// offsets it's about a quarter smaller (compare B/op).
+
+func BenchmarkAttachmentMapTickets(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m := make(map[string]string)
+		for t := 1; t <= benchTickets; t++ {
+			id := strconv.Itoa(t)
+			for a := 0; a < benchTransactions*benchAttachments; a++ {
+				m[strconv.Itoa(t*1000+a)] = id
+			}
+		}
+	}
+}
+
+func BenchmarkAttachmentMapOffsets(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m := make(map[string]attachmentMeta)
+		for t := 1; t <= benchTickets; t++ {
+			id := strconv.Itoa(t)
+			for a := 0; a < benchTransactions*benchAttachments; a++ {
+				m[strconv.Itoa(t*1000+a)] = attachmentMeta{id, a / benchAttachments, a % benchAttachments}
+			}
+		}
+	}
+}
+
+// Finding an attachment by scanning its ticket costs little next to
+// reading the ticket, which both ways have to do.
+
+// benchAttachmentData returns a Data with one ticket of many attachments,
+// and the id of its last attachment, the worst case for a scan.
+func benchAttachmentData() (*Data, string) {
+	const transactions, attachments = 100, 2
+	d := &Data{
+		ts:                memSource{"1.json": testTicket(1, transactions, attachments)},
+		attachmentTickets: make(map[string]string),
+	}
+	for a := 0; a < transactions*attachments; a++ {
+		d.attachmentTickets[strconv.Itoa(1000+a)] = "1"
+	}
+	return d, strconv.Itoa(1000 + transactions*attachments - 1)
+}
+
+func BenchmarkFindAttachmentScan(b *testing.B) {
+	d, id := benchAttachmentData()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := d.FindAttachment(id); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFindAttachmentOffsets(b *testing.B) {
+	d, id := benchAttachmentData()
+	n, _ := strconv.Atoi(id)
+	meta := attachmentMeta{"1", (n - 1000) / 2, (n - 1000) % 2}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tick, err := d.GetTicket(meta.TicketID)
+		if err != nil {
+			b.Fatal(err)
+		}
+		t := tick.(map[string]interface{})
+		tr := t["Transactions"].([]interface{})[meta.TransactionOffset].(map[string]interface{})
+		att := tr["Attachments"].([]interface{})[meta.AttachmentOffset].(map[string]interface{})
+		if got := fmt.Sprint(att["id"]); got != id {
+			b.Fatalf("found attachment %v, want %v", got, id)
+		}
+	}
+}
+
+// benchIndexJSON returns an index.json array of n tickets, each with
+// benchTransactions transactions of benchAttachments attachments.
+func benchIndexJSON(n int) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for t := 1; t <= n; t++ {
+		if t > 1 {
+			buf.WriteByte(',')
+		}
+		buf.Write(testTicket(t, benchTransactions, benchAttachments))
+	}
+	buf.WriteByte(']')
+	return buf.Bytes()
+}
+
+// retainedBytes returns how much the heap in use grows by keeping what
+// load returns.
+func retainedBytes(load func() interface{}) int64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	v := load()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(v)
+	runtime.KeepAlive(load) // and its input, which isn't counted
+	return int64(after.HeapAlloc) - int64(before.HeapAlloc)
+}
+
+// What's loaded from index.json is kept for as long as the server runs,
+// so besides what loading allocates this reports the heap kept
+// afterwards as retained-B.
+func BenchmarkLoadIndex(b *testing.B) {
+	in := benchIndexJSON(benchTickets)
+	load := func() interface{} {
+		d := &Data{}
+		if err := d.LoadIndex(bytes.NewReader(in)); err != nil {
+			b.Fatal(err)
+		}
+		return d
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		load()
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(retainedBytes(load)), "retained-B")
+}
+
+func BenchmarkLoadRTGitHubMap(b *testing.B) {
+	var buf bytes.Buffer
+	for t := 1; t <= benchTickets; t++ {
+		fmt.Fprintf(&buf, "%d,%d\n", t, t+100000)
+	}
+	in := buf.Bytes()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d := &Data{}
+		if err := d.LoadRTGitHubMap(bytes.NewReader(in)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// countIndex is a bleve index that only knows its document count, for
+// sizing what's loaded.
+type countIndex struct {
+	bleveIndex
+	n uint64
+}
+
+func (c countIndex) DocCount() (uint64, error) { return c.n, nil }
+
+// Sizing the maps from the bleve document count saves growing them
+// (compare B/op between the two).
+func BenchmarkLoadIndexSized(b *testing.B) {
+	in := benchIndexJSON(benchTickets)
+	for _, bc := range []struct {
+		name  string
+		index bleve.Index
+	}{
+		{"unsized", nil},
+		{"sized", countIndex{n: benchTickets}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				d := &Data{Index: bc.index}
+				if err := d.LoadIndex(bytes.NewReader(in)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// With an AttachmentFile the attachment map is on disk rather than in the
+// heap (compare retained-B), at the cost of slower lookups.
+func BenchmarkAttachmentFile(b *testing.B) {
+	in := benchIndexJSON(benchTickets)
+	att := strconv.Itoa(benchTickets*1000 + benchTransactions*benchAttachments - 1)
+	for _, bc := range []struct {
+		name string
+		file bool
+	}{
+		{"map", false},
+		{"file", true},
+	} {
+		dir := b.TempDir()
+		load := func() interface{} {
+			d := &Data{}
+			if bc.file {
+				d.opts.AttachmentFile = filepath.Join(dir, "attachments.bin")
+			}
+			if err := d.LoadIndex(bytes.NewReader(in)); err != nil {
+				b.Fatal(err)
+			}
+			return d
+		}
+		var d *Data
+		retained := retainedBytes(func() interface{} {
+			d = load().(*Data)
+			return d
+		})
+		b.Run(bc.name+"/load", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if d := load().(*Data); d.attachmentFile != nil {
+					d.attachmentFile.Close()
+				}
+			}
+			b.ReportMetric(float64(retained), "retained-B")
+		})
+		b.Run(bc.name+"/lookup", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, ok := d.attachmentTicket(att); !ok {
+					b.Fatalf("attachment %v not found", att)
+				}
+			}
+		})
+		if d.attachmentFile != nil {
+			d.attachmentFile.Close()
+		}
+	}
+}
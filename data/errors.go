@@ -0,0 +1,66 @@
+package data
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Kinds of Error, for use with errors.Is.
+var (
+	ErrTicketNotFound     = errors.New("ticket not found")
+	ErrAttachmentNotFound = errors.New("attachment not found")
+	ErrCorruptTicket      = errors.New("corrupt ticket")
+	// ErrSearchOnly is returned for tickets and attachments when Data was
+	// opened with Options.SearchOnly.
+	ErrSearchOnly = errors.New("not available, this archive is search only")
+)
+
+// Error is returned by Data methods that fail for a specific ticket or
+// attachment.  errors.Is matches both its Kind and the underlying Err.
+type Error struct {
+	Kind error  // one of the Err* values above
+	ID   string // ticket or attachment id
+	Err  error  // underlying cause, may be nil
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%v: %v", e.ID, e.Kind)
+	}
+	return fmt.Sprintf("%v: %v: %v", e.ID, e.Kind, e.Err)
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+func (e *Error) Is(target error) bool { return target == e.Kind }
+
+// ticketError classifies an error from a TicketSource.
+func ticketError(id string, err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return &Error{ErrTicketNotFound, id, err}
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return &Error{ErrCorruptTicket, id, err}
+	}
+	return err
+}
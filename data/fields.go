@@ -0,0 +1,154 @@
+package data
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/golang/glog"
+)
+
+// expectedFields is what the server relies on in the mapping that
+// cmd/index's setupTicketMapping builds.
+var expectedFields = []struct {
+	name   string
+	typ    string
+	stored bool // fetched for search results
+	use    string
+}{
+	{"id", "number", true, "sorting and result ids"},
+	{"subject", "text", true, "search results and similar tickets"},
+	{"status", "text", true, "search results and status filters"},
+}
+
+// checkMapping warns about an index mapping that doesn't have the fields
+// the server uses, which usually means it was built by a different
+// version of cmd/index.  Searches still work, just with less in them.
+func (d *Data) checkMapping() {
+	fms := d.fieldMappings()
+	for _, e := range expectedFields {
+		fm, ok := fms[e.name]
+		switch {
+		case !ok:
+			glog.Warningf("index mapping has no %q field, needed for %s; was the index built by cmd/index?", e.name, e.use)
+		case fm.Type != e.typ:
+			glog.Warningf("index field %q is %s rather than %s, needed for %s", e.name, fm.Type, e.typ, e.use)
+		case e.stored && !fm.Store:
+			glog.Warningf("index field %q isn't stored, needed for %s", e.name, e.use)
+		}
+	}
+	if _, ok := fms["updated"]; !ok {
+		glog.Infof("index has no updated field; rebuild it to sort by when tickets were updated")
+	}
+}
+
+// fieldMappings returns the field mappings of the index, by field name.
+// Fields indexed dynamically aren't included.
+func (d *Data) fieldMappings() map[string]*mapping.FieldMapping {
+	fms := make(map[string]*mapping.FieldMapping)
+	m, ok := d.Index.Mapping().(*mapping.IndexMappingImpl)
+	if !ok {
+		return fms
+	}
+	addFieldMappings(fms, "", m.DefaultMapping)
+	for _, dm := range m.TypeMapping {
+		addFieldMappings(fms, "", dm)
+	}
+	return fms
+}
+
+func addFieldMappings(fms map[string]*mapping.FieldMapping, prefix string, dm *mapping.DocumentMapping) {
+	if dm == nil {
+		return
+	}
+	for name, sub := range dm.Properties {
+		path := prefix + name
+		for _, fm := range sub.Fields {
+			p := path
+			if fm.Name != "" && fm.Name != name {
+				p = prefix + fm.Name
+			}
+			fms[p] = fm
+		}
+		addFieldMappings(fms, path+".", sub)
+	}
+}
+
+// FieldTypes returns the mapped type ("text", "number", ...) of each
+// field in the index mapping.
+func (d *Data) FieldTypes() map[string]string {
+	types := make(map[string]string)
+	for name, fm := range d.fieldMappings() {
+		types[name] = fm.Type
+	}
+	return types
+}
+
+// SortableFields returns the fields search results can be sorted by,
+// sorted: numbers, dates and unanalyzed text, plus bleve's _score.
+// Analyzed text sorts by its terms, which isn't useful.
+func (d *Data) SortableFields() []string {
+	fields := []string{"_score"}
+	for name, fm := range d.fieldMappings() {
+		switch fm.Type {
+		case "number", "datetime", "boolean":
+			fields = append(fields, name)
+		case "text":
+			if fm.Analyzer == keyword.Name {
+				fields = append(fields, name)
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// SortBy returns the SearchOptions.SortBy for a sort parameter: a comma
+// separated list of fields, each sorting ascending or, with a leading
+// "-", descending.  Later fields break ties in earlier ones, and
+// descending id breaks any that remain.  Fields that aren't
+// SortableFields are left out and returned as bad; sortBy is nil if no
+// field was usable.
+func (d *Data) SortBy(spec string) (sortBy []string, bad []string) {
+	sortable := make(map[string]bool)
+	for _, f := range d.SortableFields() {
+		sortable[f] = true
+	}
+	hasID := false
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		name := strings.TrimPrefix(field, "-")
+		if !sortable[name] {
+			bad = append(bad, field)
+			continue
+		}
+		if name == "id" {
+			hasID = true
+		}
+		sortBy = append(sortBy, field)
+	}
+	if len(sortBy) > 0 && !hasID {
+		sortBy = append(sortBy, "-id")
+	}
+	return sortBy, bad
+}
@@ -0,0 +1,125 @@
+package data
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/blevesearch/bleve"
+)
+
+// ErrIndexLocked is returned by New when another process, or this one,
+// has the bleve index open in a way that would make opening it wait,
+// possibly forever.
+var ErrIndexLocked = errors.New("bleve index is locked")
+
+// heldIndexes counts the indexes this process has open, by lock file.
+// flock locks belong to open files, not processes, so a second open from
+// this process conflicts with its own first one just as another
+// process's would.
+var heldIndexes = struct {
+	sync.Mutex
+	n map[string]int
+}{n: map[string]int{}}
+
+// bleveIndex lets heldIndex embed a bleve.Index, which has an Index
+// method that would clash with the field name.
+type bleveIndex = bleve.Index
+
+// heldIndex is an open index, counted in heldIndexes until it's closed.
+type heldIndex struct {
+	bleveIndex
+	lockFile string
+	release  sync.Once
+}
+
+// holdIndex counts index, opened from path, in heldIndexes.
+func holdIndex(index bleve.Index, path string) bleve.Index {
+	fn := lockKey(path)
+	heldIndexes.Lock()
+	heldIndexes.n[fn]++
+	heldIndexes.Unlock()
+	return &heldIndex{bleveIndex: index, lockFile: fn}
+}
+
+func (h *heldIndex) Close() error {
+	err := h.bleveIndex.Close()
+	h.release.Do(func() {
+		heldIndexes.Lock()
+		defer heldIndexes.Unlock()
+		if heldIndexes.n[h.lockFile]--; heldIndexes.n[h.lockFile] <= 0 {
+			delete(heldIndexes.n, h.lockFile)
+		}
+	})
+	return err
+}
+
+// heldHere reports whether this process has the index at path open.
+func heldHere(path string) bool {
+	heldIndexes.Lock()
+	defer heldIndexes.Unlock()
+	return heldIndexes.n[lockKey(path)] > 0
+}
+
+// lockKey identifies the index at path in heldIndexes, however the path
+// is written.
+func lockKey(path string) string {
+	fn := indexLockFile(path)
+	if abs, err := filepath.Abs(fn); err == nil {
+		return abs
+	}
+	return fn
+}
+
+// indexLockFile returns the bolt database bleve locks when it opens the
+// index at path: the store itself for upside_down indexes, the root.bolt
+// inside it for scorch.
+func indexLockFile(path string) string {
+	store := filepath.Join(path, "store")
+	if fi, err := os.Stat(store); err == nil && fi.IsDir() {
+		return filepath.Join(store, "root.bolt")
+	}
+	return store
+}
+
+// checkIndexLock returns ErrIndexLocked if opening the index at path,
+// read-only or not, would have to wait for another process or another
+// open in this one.  bolt locks with flock, which the kernel drops when
+// the holder exits, so a lock never outlives a crash; whatever holds it
+// is still running.
+func checkIndexLock(path string, readOnly bool) error {
+	fn := indexLockFile(path)
+	locked, err := lockedElsewhere(fn, readOnly)
+	if err != nil || !locked {
+		// Let bleve report any problem with the index.
+		return nil
+	}
+	if heldHere(path) {
+		return fmt.Errorf("%w: %v is already open in this process, which can only open it again if every open is read-only (-readonlyindex)",
+			ErrIndexLocked, fn)
+	}
+	hint := "stop it, or give every server sharing the index -readonlyindex"
+	if readOnly {
+		hint = "it has the index open read-write; stop it, or give it -readonlyindex too"
+	}
+	return fmt.Errorf("%w: %v is in use by another process (fuser -v %v shows which); %v",
+		ErrIndexLocked, fn, fn, hint)
+}
@@ -0,0 +1,67 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package data
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+)
+
+func TestOpenIndexHeldHere(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.bleve")
+	index, err := bleve.New(path, bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.Close()
+
+	first, err := openIndex(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openIndex(path, true)
+	if !errors.Is(err, ErrIndexLocked) || !strings.Contains(err.Error(), "this process") {
+		t.Errorf("opening an index this process has open read-write: %v, want ErrIndexLocked blaming this process", err)
+	}
+	first.Close()
+
+	// Closed, and only read-only from now on, it opens again any number
+	// of times.
+	var opened []bleve.Index
+	for i := 0; i < 2; i++ {
+		index, err := openIndex(path, true)
+		if err != nil {
+			t.Fatalf("read-only open %d: %v", i, err)
+		}
+		opened = append(opened, index)
+	}
+	if !heldHere(path) {
+		t.Errorf("heldHere(%v) = false with the index open", path)
+	}
+	for _, index := range opened {
+		index.Close()
+	}
+	if heldHere(path) {
+		t.Errorf("heldHere(%v) = true after closing the index", path)
+	}
+}
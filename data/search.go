@@ -0,0 +1,251 @@
+package data
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/query"
+	"github.com/golang/glog"
+)
+
+// Ticket is a search result.
+type Ticket struct {
+	ID      string `json:"Id"`
+	Status  string
+	Subject string
+	// MergedInto is the ticket this one was merged into, if any.
+	MergedInto string `json:",omitempty"`
+	// Score is the relevance score from bleve.
+	Score float64 `json:",omitempty"`
+	// Updated is when the ticket last changed.  It's nil, and left out
+	// of JSON, for tickets, or indexes, without one.
+	Updated *time.Time `json:",omitempty"`
+	// Fields holds every stored field that was requested, formatted for
+	// display.
+	Fields map[string]string `json:"-"`
+	// Fragments holds highlighted fragments by field, if highlighting was
+	// requested.
+	Fragments map[string][]string `json:"-"`
+}
+
+// DefaultSearchFields are the stored fields fetched when
+// SearchOptions.Fields is empty.
+var DefaultSearchFields = []string{"id", "status", "subject"}
+
+// DefaultQuery is the query used for "*" searches when no other default
+// is configured.  "*" itself would match, and load, every ticket.
+const DefaultQuery = "status:*"
+
+// NewTicketSearch returns the options for a search the way the web UI
+// runs it, so other tools get the same results for the same input.  q
+// of "*", or an empty q with statuses, becomes defaultQuery (DefaultQuery
+// if that's empty).  order "0" sorts by ascending id, "updated" by most
+// recently updated, and anything else, including an invalid value, by
+// descending id.
+func NewTicketSearch(q, order string, statuses []string, defaultQuery string) SearchOptions {
+	if defaultQuery == "" {
+		defaultQuery = DefaultQuery
+	}
+	if q == "*" || (q == "" && len(statuses) > 0) {
+		q = defaultQuery
+	}
+	opts := SearchOptions{
+		Query:    q,
+		SortBy:   []string{"-id"},
+		Statuses: statuses,
+	}
+	switch order {
+	case "0":
+		opts.SortBy = []string{"id"}
+	case "updated":
+		opts.SortBy = []string{"-updated", "-id"}
+	}
+	return opts
+}
+
+// SearchOptions describes a search.
+type SearchOptions struct {
+	Query string // bleve query string syntax
+	Start int    // offset of the first result
+	Size  int    // number of results, 10 if unset
+	// SortBy is passed to bleve, e.g. []string{"-id"}, which is the default.
+	SortBy []string
+	// Fields are the stored fields to fetch, DefaultSearchFields if unset.
+	// id and updated are always fetched.
+	Fields []string
+	// After continues from the SearchMeta.After of a previous search with
+	// the same SortBy, instead of using Start.
+	After []string
+	// Statuses, if set, restricts the results to tickets with one of
+	// these statuses.
+	Statuses []string
+	// ExcludeStatuses leaves out tickets with any of these statuses.
+	ExcludeStatuses []string
+	// Highlight names a bleve highlighter style, e.g. "ansi" or "html".
+	// No highlighting is done if it's empty.
+	Highlight string
+}
+
+// SearchMeta describes the results of a search as a whole.
+type SearchMeta struct {
+	Total uint64
+	Took  time.Duration
+	// After is the sort key of the last hit, for paging with
+	// SearchOptions.After.
+	After []string
+}
+
+// missingFieldsOnce limits the warning about hits without the requested
+// stored fields, which would otherwise be logged for every search.
+var missingFieldsOnce sync.Once
+
+// Search runs a query against the bleve index.
+func (d *Data) Search(ctx context.Context, opts SearchOptions) ([]Ticket, SearchMeta, error) {
+	size := opts.Size
+	if size <= 0 {
+		size = 10
+	}
+	var q query.Query = bleve.NewQueryStringQuery(opts.Query)
+	if len(opts.Statuses) > 0 {
+		sts := bleve.NewDisjunctionQuery()
+		for _, st := range opts.Statuses {
+			mq := bleve.NewMatchPhraseQuery(st) // "pending release" is two terms
+			mq.SetField("status")
+			sts.AddQuery(mq)
+		}
+		q = bleve.NewConjunctionQuery(q, sts)
+	}
+	if len(opts.ExcludeStatuses) > 0 {
+		bq := bleve.NewBooleanQuery()
+		bq.AddMust(q)
+		for _, st := range opts.ExcludeStatuses {
+			mq := bleve.NewMatchPhraseQuery(st)
+			mq.SetField("status")
+			bq.AddMustNot(mq)
+		}
+		q = bq
+	}
+	sr := bleve.NewSearchRequestOptions(q, size, opts.Start, false)
+
+	sortBy := opts.SortBy
+	if len(sortBy) == 0 {
+		sortBy = []string{"-id"}
+	}
+	sr.SortBy(sortBy)
+	if opts.After != nil {
+		sr.SetSearchAfter(opts.After)
+	}
+
+	sr.Fields = []string{"id", "updated"}
+	fields := opts.Fields
+	if len(fields) == 0 {
+		fields = DefaultSearchFields
+	}
+	for _, f := range fields {
+		if f != "id" && f != "updated" {
+			sr.Fields = append(sr.Fields, f)
+		}
+	}
+
+	if opts.Highlight != "" {
+		sr.Highlight = bleve.NewHighlightWithStyle(opts.Highlight)
+	}
+
+	res, err := d.Index.SearchInContext(ctx, sr)
+	if err != nil {
+		return nil, SearchMeta{}, err
+	}
+
+	tickets := make([]Ticket, 0, len(res.Hits))
+	missing := ""
+	for _, h := range res.Hits {
+		for _, f := range sr.Fields {
+			if _, ok := h.Fields[f]; !ok && missing == "" {
+				missing = f
+			}
+		}
+		t := hitToTicket(h)
+		t.MergedInto = d.Merged[t.ID]
+		tickets = append(tickets, t)
+	}
+	if missing != "" {
+		// The hits are still usable, with empty values.
+		missingFieldsOnce.Do(func() {
+			glog.Warningf("search %q: hit has no stored %q field; was the index built with a different mapping?", opts.Query, missing)
+		})
+	}
+	meta := SearchMeta{Total: res.Total, Took: res.Took}
+	if len(res.Hits) > 0 {
+		meta.After = res.Hits[len(res.Hits)-1].Sort
+	}
+	return tickets, meta, nil
+}
+
+// fieldString formats a stored field value for display.
+func fieldString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		var parts []string
+		for _, p := range v {
+			parts = append(parts, fieldString(p))
+		}
+		return strings.Join(parts, ", ")
+	}
+	return fmt.Sprint(v)
+}
+
+// TimeLayout is how RT formats dates, in UTC.  The updated field is
+// shown this way too.
+const TimeLayout = "2006-01-02 15:04:05"
+
+func hitToTicket(h *search.DocumentMatch) Ticket {
+	t := Ticket{
+		ID:        h.ID, // the document id is the ticket id
+		Score:     h.Score,
+		Fields:    make(map[string]string),
+		Fragments: h.Fragments,
+	}
+	for k, v := range h.Fields {
+		t.Fields[k] = fieldString(v)
+	}
+	if id := t.Fields["id"]; id != "" {
+		t.ID = id // normally a float64, but any stored form will do
+	}
+	t.Fields["id"] = t.ID
+	if u, ok := h.Fields["updated"].(float64); ok {
+		updated := time.Unix(int64(u), 0).UTC()
+		t.Updated = &updated
+		t.Fields["updated"] = updated.Format(TimeLayout)
+	}
+	t.Subject = t.Fields["subject"]
+	t.Status = t.Fields["status"]
+	return t
+}
@@ -3,6 +3,7 @@ module github.com/rspier/rt-static
 go 1.18
 
 require (
+	github.com/andybalholm/brotli v1.1.0
 	github.com/blevesearch/bleve v1.0.14
 	github.com/golang/glog v1.2.1
 	github.com/gorilla/mux v1.8.1
@@ -0,0 +1,76 @@
+package readers
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Latin1Fallback makes CleanJSON read files that aren't valid UTF-8 as
+// ISO-8859-1.  It's off by default because a mostly UTF-8 file with a
+// stray bad byte would have all its other non-ASCII text garbled;
+// json.Unmarshal replaces just the bad bytes with U+FFFD.
+var Latin1Fallback = false
+
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// CleanJSON returns b as UTF-8 without a byte order mark, which
+// json.Unmarshal rejects.  UTF-16 with a BOM is transcoded, as is
+// ISO-8859-1 if Latin1Fallback is set.
+func CleanJSON(b []byte) []byte {
+	switch {
+	case bytes.HasPrefix(b, bomUTF8):
+		return b[len(bomUTF8):]
+	case bytes.HasPrefix(b, bomUTF16LE):
+		return fromUTF16(b[2:], binary.LittleEndian)
+	case bytes.HasPrefix(b, bomUTF16BE):
+		return fromUTF16(b[2:], binary.BigEndian)
+	}
+	if Latin1Fallback && !utf8.Valid(b) {
+		return fromLatin1(b)
+	}
+	return b
+}
+
+func fromUTF16(b []byte, order binary.ByteOrder) []byte {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = order.Uint16(b[2*i:])
+	}
+	var buf bytes.Buffer
+	for _, r := range utf16.Decode(u) {
+		buf.WriteRune(r)
+	}
+	return buf.Bytes()
+}
+
+// fromLatin1 transcodes ISO-8859-1, where every byte is the code point of
+// the same value.
+func fromLatin1(b []byte) []byte {
+	buf := make([]byte, 0, len(b)+len(b)/8)
+	for _, c := range b {
+		buf = utf8.AppendRune(buf, rune(c))
+	}
+	return buf
+}
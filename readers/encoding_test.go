@@ -0,0 +1,93 @@
+package readers
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+)
+
+// utf16JSON encodes s as UTF-16 with a byte order mark.
+func utf16JSON(s string, order binary.ByteOrder, bom []byte) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, len(bom)+2*len(u))
+	copy(b, bom)
+	for i, c := range u {
+		order.PutUint16(b[len(bom)+2*i:], c)
+	}
+	return b
+}
+
+func TestCleanJSON(t *testing.T) {
+	const want = `{"Subject": "Café – naïve"}`
+	tests := []struct {
+		name   string
+		in     []byte
+		latin1 bool
+		want   string
+	}{
+		{"UTF-8", []byte(want), false, want},
+		{"UTF-8 with fallback", []byte(want), true, want}, // valid UTF-8 isn't transcoded
+		{"UTF-8 BOM", append([]byte("\xef\xbb\xbf"), want...), false, want},
+		{"UTF-16LE", utf16JSON(want, binary.LittleEndian, bomUTF16LE), false, want},
+		{"UTF-16BE", utf16JSON(want, binary.BigEndian, bomUTF16BE), false, want},
+		{"Latin-1", []byte("{\"Subject\": \"Caf\xe9 na\xefve\"}"), true, `{"Subject": "Café naïve"}`},
+		{"Latin-1 without fallback", []byte("{\"Subject\": \"Caf\xe9\"}"), false, "{\"Subject\": \"Caf\xe9\"}"},
+	}
+	defer func(fallback bool) { Latin1Fallback = fallback }(Latin1Fallback)
+	for _, tc := range tests {
+		Latin1Fallback = tc.latin1
+		if got := string(CleanJSON(tc.in)); got != tc.want {
+			t.Errorf("%v: CleanJSON = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestGetTicketEncodings(t *testing.T) {
+	defer func(fallback bool) { Latin1Fallback = fallback }(Latin1Fallback)
+	Latin1Fallback = true
+
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"1.json": []byte(`{"Id": "1", "Subject": "Café"}`),
+		"2.json": append([]byte("\xef\xbb\xbf"), `{"Id": "2", "Subject": "Café"}`...),
+		"3.json": []byte("{\"Id\": \"3\", \"Subject\": \"Caf\xe9\"}"),
+		"4.json": utf16JSON(`{"Id": "4", "Subject": "Café"}`, binary.LittleEndian, bomUTF16LE),
+	}
+	for fn, b := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fr, err := NewFileReader(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1", "2", "3", "4"} {
+		tick, err := fr.GetTicket(id)
+		if err != nil {
+			t.Errorf("GetTicket(%v): %v", id, err)
+			continue
+		}
+		if got := tick.(map[string]interface{})["Subject"]; got != "Café" {
+			t.Errorf("GetTicket(%v): Subject %q, want %q", id, got, "Café")
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package readers
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// Source is the interface shared by the readers in this package.
+type Source interface {
+	GetTicket(id string) (interface{}, error)
+	GetJSON(id string) (io.ReadCloser, error)
+	GetFile(name string) (io.ReadCloser, error)
+	TicketIDs() ([]string, error)
+	Close() error
+}
+
+type fallbackReader struct {
+	srcs []Source
+}
+
+// NewFallbackReader layers several sources.  Each lookup tries the sources
+// in order and moves to the next one only when a file does not exist, so
+// earlier sources take precedence, e.g. a directory of updated tickets in
+// front of a base zip.
+func NewFallbackReader(srcs ...Source) *fallbackReader {
+	return &fallbackReader{srcs: srcs}
+}
+
+func notFound(err error) bool {
+	return errors.Is(err, os.ErrNotExist)
+}
+
+func (fr *fallbackReader) GetTicket(id string) (interface{}, error) {
+	err := error(os.ErrNotExist)
+	for _, s := range fr.srcs {
+		var t interface{}
+		t, err = s.GetTicket(id)
+		if !notFound(err) {
+			return t, err
+		}
+	}
+	return nil, err // the last source's not-found error
+}
+
+// open returns the first file fn finds.
+func (fr *fallbackReader) open(fn func(Source) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	err := error(os.ErrNotExist)
+	for _, s := range fr.srcs {
+		var r io.ReadCloser
+		r, err = fn(s)
+		if !notFound(err) {
+			return r, err
+		}
+	}
+	return nil, err
+}
+
+func (fr *fallbackReader) GetJSON(id string) (io.ReadCloser, error) {
+	return fr.open(func(s Source) (io.ReadCloser, error) { return s.GetJSON(id) })
+}
+
+func (fr *fallbackReader) GetFile(name string) (io.ReadCloser, error) {
+	return fr.open(func(s Source) (io.ReadCloser, error) { return s.GetFile(name) })
+}
+
+// TicketIDs returns the ids of the tickets in any of the sources, sorted
+// and without duplicates.
+func (fr *fallbackReader) TicketIDs() ([]string, error) {
+	var names []string
+	for _, s := range fr.srcs {
+		ids, err := s.TicketIDs()
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			names = append(names, id+".json")
+		}
+	}
+	return ticketIDs(names), nil
+}
+
+// Close closes every source and returns the first error.
+func (fr *fallbackReader) Close() error {
+	var err error
+	for _, s := range fr.srcs {
+		if cErr := s.Close(); err == nil {
+			err = cErr
+		}
+	}
+	return err
+}
@@ -18,23 +18,79 @@ limitations under the License.
 
 import (
 	"archive/zip"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 )
 
 func parseTicket(b []byte) (interface{}, error) {
 	var d interface{}
-	err := json.Unmarshal(b, &d)
+	err := json.Unmarshal(CleanJSON(b), &d)
 	if err != nil {
 		return nil, err
 	}
 	return d, nil
 }
 
+// ticketFile matches the names of ticket files, as opposed to index.json
+// and the other files kept alongside them.
+var ticketFile = regexp.MustCompile(`^([0-9]+)\.json(\.gz)?$`)
+
+// ticketIDs returns the ids of the ticket files among names, sorted and
+// without duplicates.
+func ticketIDs(names []string) []string {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, n := range names {
+		m := ticketFile.FindStringSubmatch(n)
+		if m == nil || seen[m[1]] {
+			continue
+		}
+		seen[m[1]] = true
+		ids = append(ids, m[1])
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// gzipReadCloser closes both the gzip.Reader and the file underneath it.
+type gzipReadCloser struct {
+	*gzip.Reader
+	f io.ReadCloser
+}
+
+func (g gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// getJSON opens id.json via getFile, falling back to a gzipped id.json.gz
+// that is decompressed on the fly.
+func getJSON(getFile func(string) (io.ReadCloser, error), id string) (io.ReadCloser, error) {
+	r, err := getFile(id + ".json")
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return r, err
+	}
+	f, gzErr := getFile(id + ".json.gz")
+	if gzErr != nil {
+		return nil, err // report the uncompressed name
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%v.json.gz: %w", id, err)
+	}
+	return gzipReadCloser{zr, f}, nil
+}
+
 type fileReader struct {
 	Root string
 }
@@ -47,19 +103,44 @@ func NewFileReader(root string) (*fileReader, error) {
 }
 
 func (fr fileReader) GetJSON(id string) (io.ReadCloser, error) {
-	return fr.GetFile(string(id) + ".json")
+	return getJSON(fr.GetFile, id)
 }
 
 func (fr fileReader) GetFile(name string) (io.ReadCloser, error) {
-	return os.Open(filepath.Join(fr.Root, name))
+	// The *PathError from os.Open satisfies errors.Is(err, os.ErrNotExist)
+	// on every OS, which is what callers check.
+	f, err := os.Open(filepath.Join(fr.Root, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err // avoid returning a non-nil interface holding a nil *os.File
+	}
+	return f, nil
+}
+
+// TicketIDs returns the ids of the tickets in the directory.
+func (fr fileReader) TicketIDs() ([]string, error) {
+	f, err := os.Open(fr.Root)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	return ticketIDs(names), nil
+}
+
+// Close does nothing, files are opened and closed as they're read.
+func (fr fileReader) Close() error {
+	return nil
 }
 
 func (fr fileReader) GetTicket(id string) (interface{}, error) {
 	r, err := fr.GetJSON(id)
-	defer r.Close()
 	if err != nil {
 		return nil, err
 	}
+	defer r.Close()
 	b, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
@@ -69,12 +150,26 @@ func (fr fileReader) GetTicket(id string) (interface{}, error) {
 
 type zipReader struct {
 	zipfile string
+	prefix  string // directory in the zip the names are relative to, "" or ending in "/"
 	rdr     *zip.ReadCloser
 	Files   map[string]*zip.File
 }
 
-// NewZipReader opens a zipfile and creates a zipReader.
+// NewZipReader opens a zipfile and creates a zipReader.  Zips packed from
+// outside the data directory keep all their files under a directory, like
+// out/1234.json; the deepest directory every file is in is found and
+// names are looked up relative to it.
 func NewZipReader(filename string) (*zipReader, error) {
+	return newZipReader(filename, "", true)
+}
+
+// NewZipReaderAt is NewZipReader with the directory in the zip that holds
+// the data given rather than found.  "" or "/" is the top level.
+func NewZipReaderAt(filename, prefix string) (*zipReader, error) {
+	return newZipReader(filename, prefix, false)
+}
+
+func newZipReader(filename, prefix string, detect bool) (*zipReader, error) {
 	zr := &zipReader{
 		zipfile: filename,
 	}
@@ -85,26 +180,75 @@ func NewZipReader(filename string) (*zipReader, error) {
 	}
 	zr.rdr = r
 
+	if detect {
+		prefix = commonDir(r.File)
+	}
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		prefix += "/"
+	}
+	zr.prefix = prefix
+
 	zr.Files = make(map[string]*zip.File)
 	for _, f := range r.File {
-		zr.Files[f.Name] = f
+		if strings.HasPrefix(f.Name, prefix) {
+			zr.Files[f.Name[len(prefix):]] = f
+		}
 	}
 
 	return zr, nil
 }
 
+// commonDir returns the deepest directory, ending in "/", that contains
+// every file in the zip, or "" if they don't share one.  The __MACOSX
+// resource fork directory macOS adds is ignored.
+func commonDir(files []*zip.File) string {
+	dir, first := "", true
+	for _, f := range files {
+		if f.FileInfo().IsDir() || strings.HasPrefix(f.Name, "__MACOSX/") {
+			continue
+		}
+		d := f.Name[:strings.LastIndex(f.Name, "/")+1]
+		if first {
+			dir, first = d, false
+			continue
+		}
+		for !strings.HasPrefix(d, dir) {
+			// Drop the last directory.
+			dir = dir[:strings.LastIndex(strings.TrimSuffix(dir, "/"), "/")+1]
+		}
+		if dir == "" {
+			return ""
+		}
+	}
+	return dir
+}
+
 func (zr *zipReader) GetJSON(id string) (io.ReadCloser, error) {
-	return zr.GetFile(fmt.Sprintf("%s.json", id))
+	return getJSON(zr.GetFile, id)
 }
 
 func (zr *zipReader) GetFile(fn string) (io.ReadCloser, error) {
 	f, ok := zr.Files[fn]
 	if !ok {
-		return nil, fmt.Errorf("%w: %v not found in %v", os.ErrNotExist, fn, zr.zipfile)
+		return nil, fmt.Errorf("%w: %v not found in %v", os.ErrNotExist, zr.prefix+fn, zr.zipfile)
 	}
 	return f.Open()
 }
 
+// TicketIDs returns the ids of the tickets in the zip.
+func (zr *zipReader) TicketIDs() ([]string, error) {
+	names := make([]string, 0, len(zr.Files))
+	for n := range zr.Files {
+		names = append(names, n)
+	}
+	return ticketIDs(names), nil
+}
+
+// Close releases the zipfile.
+func (zr *zipReader) Close() error {
+	return zr.rdr.Close()
+}
+
 func (zr *zipReader) GetTicket(id string) (interface{}, error) {
 	r, err := zr.GetJSON(id)
 	if err != nil {
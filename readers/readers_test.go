@@ -0,0 +1,129 @@
+package readers
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"archive/zip"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeZip writes a zip holding files, name → content, and returns its
+// path.
+func writeZip(t *testing.T, files map[string]string) string {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "data.zip")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+// openFiles returns the number of files the process has open, or -1 if
+// that can't be told.
+func openFiles() int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fds)
+}
+
+func TestOpenCloseManyReaders(t *testing.T) {
+	fn := writeZip(t, map[string]string{
+		"out/1.json": `{"id": "1", "Subject": "one"}`,
+	})
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "1.json"), []byte(`{"id": "1"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	before := openFiles()
+	for i := 0; i < 1000; i++ {
+		zr, err := NewZipReader(fn)
+		if err != nil {
+			t.Fatalf("NewZipReader: %v", err)
+		}
+		fr, err := NewFileReader(dir)
+		if err != nil {
+			t.Fatalf("NewFileReader: %v", err)
+		}
+		src := NewFallbackReader(fr, zr)
+		if _, err := src.GetTicket("1"); err != nil {
+			t.Fatalf("GetTicket: %v", err)
+		}
+		if err := src.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+	if before < 0 {
+		t.Skip("can't count open files")
+	}
+	if after := openFiles(); after > before {
+		t.Errorf("%d files open after closing the readers, %d before", after, before)
+	}
+}
+
+func TestFileReaderNotExist(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "attachments"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "attachments", "1.bin"), []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fr, err := NewFileReader(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Names use '/' whatever the OS.
+	f, err := fr.GetFile("attachments/1.bin")
+	if err != nil {
+		t.Fatalf("GetFile(attachments/1.bin): %v", err)
+	}
+	f.Close()
+
+	for _, name := range []string{"2.json", "attachments/2.bin", "missing/1.bin"} {
+		if _, err := fr.GetFile(name); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("GetFile(%v) = %v, want an error wrapping os.ErrNotExist", name, err)
+		}
+	}
+	if _, err := fr.GetTicket("2"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("GetTicket(2) = %v, want an error wrapping os.ErrNotExist", err)
+	}
+}
@@ -0,0 +1,208 @@
+// Package synonym provides a bleve token filter that folds variant
+// spellings (e.g. "perl 5", "perl-5") onto a single canonical term.
+package synonym
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/blevesearch/bleve/analysis"
+	"github.com/blevesearch/bleve/analysis/analyzer/custom"
+	"github.com/blevesearch/bleve/analysis/lang/en"
+	"github.com/blevesearch/bleve/analysis/token/lowercase"
+	"github.com/blevesearch/bleve/analysis/token/porter"
+	unicodetok "github.com/blevesearch/bleve/analysis/tokenizer/unicode"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/registry"
+)
+
+const (
+	// Name is the registered token filter type.
+	Name = "synonym"
+	// AnalyzerName is the analyzer added by AddAnalyzer.  It is "en" with
+	// the synonym filter inserted after lowercasing.
+	AnalyzerName = "en_synonyms"
+
+	filterName = "synonyms"
+)
+
+// The mapping, including the synonym table, is persisted in the bleve
+// index, so the server only needs to import this package for the filter
+// type to be available when the index is opened.
+func init() {
+	registry.RegisterTokenFilter(Name, filterConstructor)
+}
+
+// Filter replaces runs of tokens that match a variant with the canonical
+// term.
+type Filter struct {
+	syn      map[string]string // space-joined variant tokens -> canonical
+	maxWords int
+}
+
+// NewFilter returns a Filter for the variant -> canonical map.  Variants
+// are matched against lowercased tokens and may span several words.
+func NewFilter(syn map[string]string) *Filter {
+	f := &Filter{syn: map[string]string{}, maxWords: 1}
+	for k, v := range syn {
+		words := Words(k)
+		if len(words) == 0 {
+			continue
+		}
+		if len(words) > f.maxWords {
+			f.maxWords = len(words)
+		}
+		f.syn[strings.Join(words, " ")] = v
+	}
+	return f
+}
+
+// Filter implements analysis.TokenFilter.
+func (f *Filter) Filter(input analysis.TokenStream) analysis.TokenStream {
+	rv := make(analysis.TokenStream, 0, len(input))
+	for i := 0; i < len(input); {
+		n := f.maxWords
+		if n > len(input)-i {
+			n = len(input) - i
+		}
+		for ; n > 0; n-- {
+			if c, ok := f.syn[joinTerms(input[i:i+n])]; ok {
+				tok := *input[i]
+				tok.Term = []byte(c)
+				tok.End = input[i+n-1].End
+				rv = append(rv, &tok)
+				break
+			}
+		}
+		if n == 0 {
+			rv = append(rv, input[i])
+			n = 1
+		}
+		i += n
+	}
+	return rv
+}
+
+func joinTerms(ts analysis.TokenStream) string {
+	if len(ts) == 1 {
+		return string(ts[0].Term)
+	}
+	parts := make([]string, len(ts))
+	for i, t := range ts {
+		parts[i] = string(t.Term)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Words splits s the way the unicode tokenizer roughly would: lowercased
+// runs of letters and digits.
+func Words(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func filterConstructor(config map[string]interface{}, cache *registry.Cache) (analysis.TokenFilter, error) {
+	raw, ok := config["synonyms"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("synonym filter needs a synonyms map")
+	}
+	syn := make(map[string]string, len(raw))
+	for k, v := range raw {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("synonym %q: canonical term must be a string", k)
+		}
+		syn[k] = s
+	}
+	return NewFilter(syn), nil
+}
+
+// Load reads a synonym file.  Each line lists a canonical term followed
+// by its variants, separated by commas:
+//
+//	perl5, perl 5, perl-5
+//
+// Blank lines and lines starting with # are ignored.  The result maps
+// each variant to the canonical term.
+func Load(fn string) (map[string]string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	syn := map[string]string{}
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		parts := strings.Split(l, ",")
+		canon := strings.Join(Words(parts[0]), "")
+		if canon == "" || len(parts) < 2 {
+			return nil, fmt.Errorf("%s:%d: want \"canonical, variant...\"", fn, line)
+		}
+		for _, p := range parts[1:] {
+			v := strings.Join(Words(p), " ")
+			if v == "" {
+				continue
+			}
+			if old, ok := syn[v]; ok && old != canon {
+				return nil, fmt.Errorf("%s:%d: %q already maps to %q", fn, line, v, old)
+			}
+			syn[v] = canon
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return syn, nil
+}
+
+// AddAnalyzer registers the synonym filter and the AnalyzerName analyzer
+// with m.
+func AddAnalyzer(m *mapping.IndexMappingImpl, syn map[string]string) error {
+	cfg := make(map[string]interface{}, len(syn))
+	for k, v := range syn {
+		cfg[k] = v
+	}
+	err := m.AddCustomTokenFilter(filterName, map[string]interface{}{
+		"type":     Name,
+		"synonyms": cfg,
+	})
+	if err != nil {
+		return err
+	}
+	return m.AddCustomAnalyzer(AnalyzerName, map[string]interface{}{
+		"type":      custom.Name,
+		"tokenizer": unicodetok.Name,
+		"token_filters": []string{
+			en.PossessiveName,
+			lowercase.Name,
+			filterName,
+			en.StopName,
+			porter.Name,
+		},
+	})
+}
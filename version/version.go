@@ -0,0 +1,83 @@
+// Package version describes which build of the tools is running.
+package version
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// These are set at build time, for example:
+//
+//	go build -ldflags "-X github.com/rspier/rt-static/version.Version=v1.2.3"
+var (
+	Version = ""
+	Commit  = ""
+	Date    = ""
+)
+
+// Info describes a build.
+type Info struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Date    string `json:"date"`
+}
+
+// Get returns the build information, falling back to what the Go
+// toolchain recorded for anything not set at build time.
+func Get() Info {
+	i := Info{Version: Version, Commit: Commit, Date: Date}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if i.Version == "" && bi.Main.Version != "(devel)" {
+			i.Version = bi.Main.Version
+		}
+		modified := false
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if i.Commit == "" {
+					i.Commit = s.Value
+				}
+			case "vcs.time":
+				if i.Date == "" {
+					i.Date = s.Value
+				}
+			case "vcs.modified":
+				modified = s.Value == "true"
+			}
+		}
+		if modified && Commit == "" && i.Commit != "" {
+			i.Commit += "+" // same convention as the Makefile
+		}
+	}
+	if i.Version == "" {
+		i.Version = "unknown"
+	}
+	return i
+}
+
+func (i Info) String() string {
+	return fmt.Sprintf("%s (commit %s, built %s)", i.Version, orUnknown(i.Commit), orUnknown(i.Date))
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
@@ -0,0 +1,126 @@
+package web
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rspier/rt-static/data"
+)
+
+// requireAdmin only calls h if the request carries the admin bearer token.
+// When no token is configured, admin endpoints don't exist.
+func (s *Server) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.AdminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// reloadHandler replaces Tix with freshly loaded data.  The old data keeps
+// serving while the new loads, and stays if loading fails.
+func (s *Server) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Reload == nil {
+		http.Error(w, "reload not supported", http.StatusNotImplemented)
+		return
+	}
+	if !s.reloading.TryLock() {
+		http.Error(w, "reload already in progress", http.StatusLocked)
+		return
+	}
+	defer s.reloading.Unlock()
+
+	start := time.Now()
+	tix, err := s.Reload()
+	if err != nil {
+		logf(r, "reload: %v", err)
+		http.Error(w, "reload failed: "+err.Error(), 500)
+		return
+	}
+
+	// Wait for in flight requests, and hold off new ones, only for the
+	// swap.
+	s.mu.Lock()
+	old, oldUsers := s.Tix, s.tixUsers
+	s.Tix, s.tixUsers = tix, new(sync.WaitGroup)
+	if err := s.updateInfo(); err != nil {
+		logf(r, "info: %v", err)
+	}
+	s.evictZipCache("") // the snapshot time may not have changed, but the data has
+	s.mu.Unlock()
+	logf(r, "reloaded data in %v", time.Since(start))
+
+	go func() {
+		oldUsers.Wait() // for exports and zips still streaming
+		if err := old.Close(); err != nil {
+			logf(r, "reload: closing old data: %v", err)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		SnapshotTime time.Time `json:"snapshot_time"`
+		Loaded       time.Time `json:"loaded"`
+	}{s.snapshotTime(tix), tix.Loaded})
+}
+
+// snapshotTime returns when tix was taken: SnapshotTime if it's set,
+// otherwise when tix was loaded.
+func (s *Server) snapshotTime(tix *data.Data) time.Time {
+	if !s.SnapshotTime.IsZero() {
+		return s.SnapshotTime
+	}
+	return tix.Loaded
+}
+
+// debugTicketHandler serves the stored JSON of a ticket untouched, for
+// tracking down differences between the archive and what's displayed.
+func (s *Server) debugTicketHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	rc, err := s.Tix.RawTicket(id)
+	if isNotFound(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logf(r, "RawTicket(%v): %v", id, err)
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+	defer rc.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := io.Copy(w, rc); err != nil {
+		logf(r, "debug ticket %v: %v", id, err)
+	}
+}
@@ -0,0 +1,115 @@
+package web
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rspier/rt-static/data"
+)
+
+// atomFeed is an Atom (RFC 4287) feed of search results, for feed readers
+// following a search.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string   `xml:"id"`
+	Title   string   `xml:"title"`
+	Updated string   `xml:"updated"`
+	Link    atomLink `xml:"link"`
+	Summary string   `xml:"summary"`
+}
+
+// wantsAtom reports whether the client asked for an Atom feed rather than
+// HTML, the same way wantsJSON does for JSON.
+func wantsAtom(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/atom+xml") && !strings.Contains(accept, "text/html")
+}
+
+// writeAtom serves tickets, the results of the search at permalink, as an
+// Atom feed.  Tickets without an updated date, from older indexes, are
+// dated when the data was loaded, as Atom requires a date.
+func (s *Server) writeAtom(w http.ResponseWriter, r *http.Request, title, permalink string, tickets []data.Ticket) {
+	base := s.baseURL(r)
+	fallback := s.Tix.Loaded
+	if !s.SnapshotTime.IsZero() {
+		fallback = s.SnapshotTime
+	}
+
+	f := atomFeed{
+		ID:     permalink,
+		Title:  title,
+		Author: atomPerson{s.Site},
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: permalink},
+			{Rel: "alternate", Type: "text/html", Href: permalink},
+		},
+	}
+	var latest time.Time
+	for _, t := range tickets {
+		updated := fallback
+		if t.Updated != nil {
+			updated = *t.Updated
+		}
+		if updated.After(latest) {
+			latest = updated
+		}
+		link := base + s.displayPath() + "?id=" + url.QueryEscape(t.ID)
+		f.Entries = append(f.Entries, atomEntry{
+			ID:      link,
+			Title:   "#" + t.ID + ": " + t.Subject,
+			Updated: updated.UTC().Format(time.RFC3339),
+			Link:    atomLink{Rel: "alternate", Type: "text/html", Href: link},
+			Summary: "Status: " + t.Status,
+		})
+	}
+	if latest.IsZero() {
+		latest = fallback
+	}
+	f.Updated = latest.UTC().Format(time.RFC3339)
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(f); err != nil {
+		logf(r, "atom: %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package web
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/rspier/rt-static/data"
+)
+
+// zipName makes an attachment filename safe to use in a zip, and unique
+// among the names already in seen.
+func zipName(filename string, seen map[string]bool) string {
+	name := strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, filename)
+	name = strings.Trim(name, ". ")
+	if name == "" {
+		name = "attachment"
+	}
+
+	unique := name
+	ext := path.Ext(name)
+	for i := 2; seen[unique]; i++ {
+		unique = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	seen[unique] = true
+	return unique
+}
+
+// attachmentsZipHandler serves a zip of all of a ticket's attachments.
+// Without ZipCacheDir the zip is written as it's built, so only one
+// attachment is decoded at a time, but it can't be resumed.  With
+// it, the zip is built in the cache first and served from there, with
+// ranges and conditional requests.
+func (s *Server) attachmentsZipHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	if s.hiddenTicket(id) {
+		s.notFoundHandler(w, r)
+		return
+	}
+
+	tick, err := s.Tix.GetTicket(id)
+	if isNotFound(err) {
+		s.notFoundHandler(w, r)
+		return
+	}
+	if err != nil {
+		logf(r, "GetTicket(%v): %v", id, err)
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+	if len(data.TicketAttachments(tick)) == 0 {
+		s.notFoundHandler(w, r)
+		return
+	}
+
+	if s.notModified(w, r) {
+		return
+	}
+
+	// Building the zip can take a while, so don't hold up a reload.
+	tix, done := s.detach(r)
+	defer done()
+
+	if s.ZipCacheDir != "" {
+		s.serveCachedZip(w, r, tix, id, tick)
+		return
+	}
+
+	// A zip decodes one attachment at a time, so it takes one slot.
+	release, ok := s.acquireAttachment(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	setZipHeaders(w, id)
+	err = s.writeAttachmentsZip(w, r, id, tick)
+	if err != nil {
+		// Too late for an error page, the client gets a truncated zip.
+		logf(r, "attachments.zip(%v): %v", id, err)
+	}
+}
+
+func setZipHeaders(w http.ResponseWriter, id string) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "rt-"+id+"-attachments.zip"))
+}
+
+// writeAttachmentsZip writes the zip of the attachments of tick, ticket
+// id, to w.
+func (s *Server) writeAttachmentsZip(w io.Writer, r *http.Request, id string, tick interface{}) error {
+	tooLarge := func(a data.Attachment) bool {
+		if s.MaxAttachmentBytes > 0 && a.Size > s.MaxAttachmentBytes {
+			logf(r, "attachments.zip(%v): skipping %v, %d bytes", id, a.ID, a.Size)
+			return true
+		}
+		return false
+	}
+
+	zw := zip.NewWriter(w)
+	seen := make(map[string]bool)
+	err := data.WalkAttachments(tick, tooLarge, func(a data.Attachment, content []byte) error {
+		f, err := zw.Create(zipName(a.Filename, seen))
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(content)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// zipCacheKey names the ZipCacheDir subdirectory for tix: its
+// snapshotTime, and a hash of the settings that change what goes in a
+// zip, so restarting with different ones doesn't serve stale zips.
+func (s *Server) zipCacheKey(tix *data.Data) string {
+	t := s.snapshotTime(tix)
+	h := sha256.Sum256([]byte(fmt.Sprintf("%d %q", s.MaxAttachmentBytes, s.hiddenStatuses())))
+	return fmt.Sprintf("zips-%d-%x", t.UnixNano(), h[:8])
+}
+
+// serveCachedZip serves ticket id's attachments zip from ZipCacheDir,
+// building it there from tick, read from tix, first if it isn't cached
+// yet.
+func (s *Server) serveCachedZip(w http.ResponseWriter, r *http.Request, tix *data.Data, id string, tick interface{}) {
+	fn := filepath.Join(s.ZipCacheDir, s.zipCacheKey(tix), id+".zip")
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		// A zip decodes one attachment at a time, so it takes one slot.
+		release, ok := s.acquireAttachment(w, r)
+		if !ok {
+			return
+		}
+		err = s.buildCachedZip(r, id, tick, fn)
+		release()
+		if err == nil {
+			f, err = os.Open(fn)
+		}
+	}
+	if err != nil {
+		logf(r, "attachments.zip(%v): %v", id, err)
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+	defer f.Close()
+	setZipHeaders(w, id)
+	http.ServeContent(w, r, "", s.SnapshotTime, f)
+}
+
+// buildCachedZip writes the attachments zip of tick, ticket id, to fn.
+// It's written to the side and renamed, so a partial zip is never served.
+func (s *Server) buildCachedZip(r *http.Request, id string, tick interface{}, fn string) error {
+	if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fn), "."+id+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+	err = s.writeAttachmentsZip(tmp, r, id, tick)
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fn)
+}
+
+// evictZipCache removes the cached zips other than those for keep, from
+// earlier snapshots.  An empty keep removes them all.
+func (s *Server) evictZipCache(keep string) {
+	if s.ZipCacheDir == "" {
+		return
+	}
+	old, _ := filepath.Glob(filepath.Join(s.ZipCacheDir, "zips-*"))
+	for _, o := range old {
+		if filepath.Base(o) != keep {
+			log.Printf("removing old cached zips %v", o)
+			os.RemoveAll(o)
+		}
+	}
+}
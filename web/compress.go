@@ -0,0 +1,200 @@
+package web
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressibleTypes are the media types worth compressing.  Attachments
+// and the zip downloads are mostly already compressed, and are served
+// outside compress anyway.
+var compressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/opensearchdescription+xml",
+}
+
+func compressible(contentType string) bool {
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows enc,
+// honoring q=0 and "*".
+func acceptsEncoding(header, enc string) bool {
+	star := false
+	for _, part := range strings.Split(header, ",") {
+		name, params := part, ""
+		if i := strings.Index(part, ";"); i >= 0 {
+			name, params = part[:i], part[i+1:]
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		ok := true
+		if q := strings.TrimSpace(params); strings.HasPrefix(q, "q=") {
+			v, err := strconv.ParseFloat(strings.TrimPrefix(q, "q="), 64)
+			ok = err == nil && v > 0
+		}
+		switch name {
+		case enc:
+			return ok
+		case "*":
+			star = ok
+		}
+	}
+	return star
+}
+
+// chooseEncoding returns the first of s.Compression the client accepts,
+// or "" for none.
+func (s *Server) chooseEncoding(r *http.Request) string {
+	header := r.Header.Get("Accept-Encoding")
+	if header == "" {
+		return ""
+	}
+	for _, enc := range s.Compression {
+		if acceptsEncoding(header, enc) {
+			return enc
+		}
+	}
+	return ""
+}
+
+func (s *Server) newEncoder(enc string, w io.Writer) io.WriteCloser {
+	switch enc {
+	case "br":
+		level := s.BrotliLevel
+		if level == 0 {
+			level = brotli.DefaultCompression
+		}
+		return brotli.NewWriterLevel(w, level)
+	case "gzip":
+		level := s.GzipLevel
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		zw, err := gzip.NewWriterLevel(w, level)
+		if err != nil { // an invalid level
+			log.Printf("gzip level %d: %v", level, err)
+			zw = gzip.NewWriter(w)
+		}
+		return zw
+	}
+	return nil
+}
+
+// compress encodes text responses from h with the best of s.Compression
+// the client accepts.  Responses that already have a Content-Encoding
+// are left alone.
+func (s *Server) compress(h http.Handler) http.Handler {
+	if len(s.Compression) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// HEAD has no body to encode, but gets the same Vary as GET.
+		enc := ""
+		if r.Method != http.MethodHead {
+			enc = s.chooseEncoding(r)
+		}
+		cw := &compressWriter{ResponseWriter: w, s: s, enc: enc}
+		defer cw.Close()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter decides whether to compress when the headers are
+// written, as that's when the Content-Type is known.  If the handler
+// didn't set one, the decision waits for the first Write so it can be
+// sniffed, as net/http would.
+type compressWriter struct {
+	http.ResponseWriter
+	s           *Server
+	enc         string // chosen encoding, "" if the client accepts none
+	code        int    // status held back until the first Write
+	wroteHeader bool
+	zw          io.WriteCloser // nil unless compressing
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader || cw.code != 0 {
+		return
+	}
+	if cw.Header().Get("Content-Type") == "" && code != http.StatusNoContent && code != http.StatusNotModified {
+		cw.code = code
+		return
+	}
+	cw.writeHeader(code)
+}
+
+func (cw *compressWriter) writeHeader(code int) {
+	cw.wroteHeader = true
+	hdr := cw.Header()
+	if code == http.StatusNotModified {
+		// It stands for a full response, which may have been compressed.
+		hdr.Add("Vary", "Accept-Encoding")
+	} else if code != http.StatusNoContent &&
+		hdr.Get("Content-Encoding") == "" && compressible(hdr.Get("Content-Type")) {
+		hdr.Add("Vary", "Accept-Encoding")
+		if cw.enc != "" {
+			hdr.Set("Content-Encoding", cw.enc)
+			hdr.Del("Content-Length")
+			cw.zw = cw.s.newEncoder(cw.enc, cw.ResponseWriter)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		code := cw.code
+		if code == 0 {
+			code = http.StatusOK
+		}
+		cw.writeHeader(code)
+	}
+	if cw.zw != nil {
+		return cw.zw.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Close sends a held back status, and finishes the compressed stream if
+// there is one.
+func (cw *compressWriter) Close() error {
+	if !cw.wroteHeader && cw.code != 0 {
+		cw.writeHeader(cw.code)
+	}
+	if cw.zw == nil {
+		return nil
+	}
+	return cw.zw.Close()
+}
@@ -0,0 +1,61 @@
+package web
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompressVary(t *testing.T) {
+	s := &Server{Compression: []string{"gzip"}}
+	h := testServer(t, s)
+	since := s.SnapshotTime.Format(http.TimeFormat)
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		hdr      []string
+		wantCode int
+		wantEnc  string
+	}{
+		{"GET", "GET", "/Ticket/Display.html?id=1", nil, http.StatusOK, "gzip"},
+		{"HEAD", "HEAD", "/Ticket/Display.html?id=1", nil, http.StatusOK, ""},
+		{"304", "GET", "/Ticket/Display.html?id=1", []string{"If-Modified-Since", since}, http.StatusNotModified, ""},
+		{"search 304", "GET", "/Search/Simple.html?q=perl", []string{"If-Modified-Since", since}, http.StatusNotModified, ""},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(tc.method, tc.target, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		for i := 0; i+1 < len(tc.hdr); i += 2 {
+			r.Header.Set(tc.hdr[i], tc.hdr[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.wantCode {
+			t.Errorf("%v: status %v, want %v", tc.name, w.Code, tc.wantCode)
+		}
+		if got := w.Header().Get("Content-Encoding"); got != tc.wantEnc {
+			t.Errorf("%v: Content-Encoding %q, want %q", tc.name, got, tc.wantEnc)
+		}
+		if got := w.Header().Values("Vary"); !hasField(got, "Accept-Encoding") {
+			t.Errorf("%v: Vary %q, want Accept-Encoding", tc.name, got)
+		}
+	}
+}
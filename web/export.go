@@ -0,0 +1,130 @@
+package web
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strconv"
+
+	"github.com/rspier/rt-static/data"
+)
+
+const (
+	// exportPageSize is how many hits are fetched from bleve at a time.
+	exportPageSize = 1000
+	// defaultExportMaxRows bounds an export when Server.ExportMaxRows is unset.
+	defaultExportMaxRows = 100000
+)
+
+// exportHandler streams the results of a search as CSV, with the columns
+// given by a fields= parameter or id, status and subject.  The status,
+// order and sort parameters work as on the search page, so the export
+// has the tickets the page shows, in the same order.  Rather than
+// asking bleve for everything at once, it pages through the results with
+// SearchOptions.After and flushes each page to the client.  The number of
+// matching tickets is sent in an X-Export-Total header, and if that's more
+// than the row limit, X-Export-Truncated says how many rows were sent.
+func (s *Server) exportHandler(w http.ResponseWriter, r *http.Request) {
+	params, _ := parseSearchParams(r, s.statuses())
+	opts := data.NewTicketSearch(params.Query, params.Order, params.Statuses, s.defaultQuery())
+	if opts.Query == "" {
+		opts.Query = s.defaultQuery()
+	}
+	if params.Sort != "" {
+		if sb, _ := s.Tix.SortBy(params.Sort); sb != nil {
+			opts.SortBy = sb
+		}
+	}
+	opts.ExcludeStatuses = s.hiddenStatuses()
+	q := opts.Query
+	maxRows := s.ExportMaxRows
+	if maxRows <= 0 {
+		maxRows = defaultExportMaxRows
+	}
+
+	fields := requestFields(r)
+	if len(fields) == 0 {
+		fields = data.DefaultSearchFields
+	}
+	opts.Fields = fields
+
+	tix, done := s.detach(r)
+	defer done()
+
+	flusher, _ := w.(http.Flusher) // may be nil
+	cw := csv.NewWriter(w)
+
+	var after []string
+	rows, truncated := 0, false
+	for rows < maxRows {
+		size := exportPageSize
+		if maxRows-rows < size {
+			size = maxRows - rows
+		}
+
+		opts.Size = size
+		opts.After = after
+		tickets, meta, err := tix.Search(r.Context(), opts)
+		if err != nil {
+			if after == nil {
+				// nothing has been sent yet, so we can still report it.
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logf(r, "export(%q) after %d rows: %v", q, rows, err)
+			return
+		}
+
+		if after == nil {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", `attachment; filename="export.csv"`)
+			w.Header().Set("X-Export-Total", strconv.FormatUint(meta.Total, 10))
+			if meta.Total > uint64(maxRows) {
+				truncated = true
+				w.Header().Set("X-Export-Truncated", strconv.Itoa(maxRows))
+			}
+			cw.Write(fields)
+		}
+
+		row := make([]string, len(fields))
+		for _, t := range tickets {
+			for i, f := range fields {
+				row[i] = t.Fields[f]
+			}
+			cw.Write(row)
+		}
+		rows += len(tickets)
+
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			logf(r, "export(%q) after %d rows: %v", q, rows, err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if len(tickets) < size {
+			break
+		}
+		after = meta.After
+	}
+	if truncated {
+		logf(r, "export(%q) truncated at %d rows", q, rows)
+	}
+}
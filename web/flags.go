@@ -0,0 +1,61 @@
+package web
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+)
+
+// ObfuscationFlags defines the flags choosing EmailObfuscation on fs, so
+// the server and render hide addresses the same way.  The function it
+// returns sets EmailObfuscation from them once they've been parsed.
+func ObfuscationFlags(fs *flag.FlagSet) func() error {
+	obfuscate := fs.String("obfuscate", "elide", "how to hide email addresses: elide shows the first characters, hash shows a stable hash")
+	elideLocal := fs.Int("elidelocal", 4, "characters of an address's local part shown with -obfuscate=elide")
+	elideDomain := fs.Int("elidedomain", 3, "characters of an address's domain shown with -obfuscate=elide")
+	hashKeyFile := fs.String("hashkeyfile", "", "file containing the key for -obfuscate=hash, which requires it")
+
+	return func() error {
+		o := Obfuscation{LocalChars: *elideLocal, DomainChars: *elideDomain}
+		switch *obfuscate {
+		case "elide":
+		case "hash":
+			// Without a secret key, anyone can hash guessed addresses and
+			// compare, so the hashes would hide nothing.
+			if *hashKeyFile == "" {
+				return errors.New("-obfuscate=hash needs -hashkeyfile")
+			}
+			b, err := ioutil.ReadFile(*hashKeyFile)
+			if err != nil {
+				return err
+			}
+			o.Hash = true
+			o.HashKey = bytes.TrimSpace(b)
+			if len(o.HashKey) == 0 {
+				return fmt.Errorf("-hashkeyfile %v is empty", *hashKeyFile)
+			}
+		default:
+			return fmt.Errorf("-obfuscate must be elide or hash, not %q", *obfuscate)
+		}
+		EmailObfuscation = o
+		return nil
+	}
+}
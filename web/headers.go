@@ -0,0 +1,50 @@
+package web
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import "net/http"
+
+// DefaultCSP allows what the templates use: Bootstrap, jQuery, Popper and
+// Font Awesome from their CDNs, and inline styles.  Scripts are never
+// inline; the event handlers are in static/js/site.js.  Everything else,
+// in particular anything archived content might try to load, is limited
+// to this site.
+const DefaultCSP = "default-src 'self'; " +
+	"script-src 'self' https://code.jquery.com https://stackpath.bootstrapcdn.com https://cdnjs.cloudflare.com; " +
+	"style-src 'self' 'unsafe-inline' https://stackpath.bootstrapcdn.com; " +
+	"font-src 'self' https://stackpath.bootstrapcdn.com; " +
+	"img-src 'self' data: https:; " + // -logo may be elsewhere
+	"object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors 'none'"
+
+// securityHeaders sets the security headers on every response: nosniff
+// always, and the configured ones that aren't empty.
+func (s *Server) securityHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hdr := w.Header()
+		hdr.Set("X-Content-Type-Options", "nosniff")
+		if s.CSP != "" {
+			hdr.Set("Content-Security-Policy", s.CSP)
+		}
+		if s.ReferrerPolicy != "" {
+			hdr.Set("Referrer-Policy", s.ReferrerPolicy)
+		}
+		if s.FrameOptions != "" {
+			hdr.Set("X-Frame-Options", s.FrameOptions)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,63 @@
+package web
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/rspier/rt-static/data"
+	"github.com/rspier/rt-static/version"
+)
+
+// serverInfo is served by /api/info, for monitoring to check that a
+// deploy has the expected build and corpus.
+type serverInfo struct {
+	Build        version.Info `json:"build"`
+	SnapshotTime *time.Time   `json:"snapshot_time,omitempty"`
+	Loaded       time.Time    `json:"loaded"`
+	SearchOnly   bool         `json:"search_only"`
+	data.Summary
+	GitHubMap bool `json:"github_map"` // whether any GitHub mappings were loaded
+	MergedMap bool `json:"merged_map"`
+}
+
+// updateInfo recomputes s.info from Tix.  It's called when Tix is set up
+// or replaced, so requests just serve the cached value.  An error summing
+// up Tix is returned for logging, but s.info is still updated.
+func (s *Server) updateInfo() error {
+	sum, err := s.Tix.Summary()
+	i := &serverInfo{
+		Build:      version.Get(),
+		Loaded:     s.Tix.Loaded,
+		SearchOnly: s.Tix.SearchOnly(),
+		Summary:    sum,
+		GitHubMap:  sum.GitHubMappings > 0,
+		MergedMap:  sum.Merged > 0,
+	}
+	if !s.SnapshotTime.IsZero() {
+		t := s.SnapshotTime
+		i.SnapshotTime = &t
+	}
+	s.info = i
+	return err
+}
+
+func (s *Server) apiInfoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, r, s.info)
+}
@@ -0,0 +1,40 @@
+// Package testroot changes to the root of the repository, which the
+// template paths given to page.NewTemplate are relative to.  Templates
+// are parsed when their package is initialised, before any test runs, so
+// tests import testroot for its side effect and it runs first:
+//
+//	import _ "github.com/rspier/rt-static/web/internal/testroot"
+package testroot
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+func init() {
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		panic("testroot: can't find the source file")
+	}
+	// This file is web/internal/testroot/testroot.go.
+	if err := os.Chdir(filepath.Join(filepath.Dir(file), "..", "..", "..")); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,86 @@
+package web
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"fmt"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+var (
+	// ticketRefRe matches references like "ticket #123", "RT#123",
+	// "bug #123" and the "[rt.perl.org #123]" RT puts in subjects.
+	ticketRefRe = regexp.MustCompile(`(?i)\b(?:ticket|rt|bug)\s?#(\d+)\b|\[[\w.-]+ #(\d+)\]`)
+	urlRe       = regexp.MustCompile(`(?i)\b(?:https?|ftp)://\S+`)
+)
+
+// isCodeLine reports whether a line looks like indented code.
+func isCodeLine(line string) bool {
+	return strings.HasPrefix(line, "\t") || strings.HasPrefix(line, "    ")
+}
+
+// inSpans reports whether [start, end) overlaps any of spans.
+func inSpans(start, end int, spans [][]int) bool {
+	for _, s := range spans {
+		if start < s[1] && end > s[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// linkTickets HTML escapes text, turning references to other tickets
+// into links to displayURL.  References in indented or fenced code, or that are part
+// of a URL, are left alone.
+func linkTickets(displayURL string, textI interface{}) template.HTML {
+	// accept an interface{} to deal with the nil case easily.
+	text, _ := textI.(string)
+
+	var b strings.Builder
+	inFence := false
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+		}
+		if inFence || isCodeLine(line) {
+			b.WriteString(template.HTMLEscapeString(line))
+			continue
+		}
+
+		urls := urlRe.FindAllStringIndex(line, -1)
+		last := 0
+		for _, m := range ticketRefRe.FindAllStringSubmatchIndex(line, -1) {
+			if inSpans(m[0], m[1], urls) {
+				continue
+			}
+			id := ""
+			if m[2] >= 0 {
+				id = line[m[2]:m[3]]
+			} else {
+				id = line[m[4]:m[5]]
+			}
+			b.WriteString(template.HTMLEscapeString(line[last:m[0]]))
+			fmt.Fprintf(&b, `<a href="%s?id=%s">%s</a>`,
+				template.HTMLEscapeString(displayURL), id, template.HTMLEscapeString(line[m[0]:m[1]]))
+			last = m[1]
+		}
+		b.WriteString(template.HTMLEscapeString(line[last:]))
+	}
+	return template.HTML(b.String())
+}
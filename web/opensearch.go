@@ -0,0 +1,78 @@
+package web
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"encoding/xml"
+	"net/http"
+)
+
+// openSearchDescription is an OpenSearch 1.1 description document, which
+// lets browsers add the archive as a search engine.
+type openSearchDescription struct {
+	XMLName       xml.Name `xml:"http://a9.com/-/spec/opensearch/1.1/ OpenSearchDescription"`
+	ShortName     string   `xml:"ShortName"`
+	Description   string   `xml:"Description"`
+	InputEncoding string   `xml:"InputEncoding"`
+	Image         struct {
+		Width  int    `xml:"width,attr"`
+		Height int    `xml:"height,attr"`
+		Type   string `xml:"type,attr"`
+		URL    string `xml:",chardata"`
+	} `xml:"Image"`
+	URL struct {
+		Type     string `xml:"type,attr"`
+		Method   string `xml:"method,attr"`
+		Template string `xml:"template,attr"`
+	} `xml:"Url"`
+}
+
+// baseURL returns the absolute URL of the site root, including Prefix.
+func (s *Server) baseURL(r *http.Request) string {
+	host := r.Host
+	if s.CanonicalHost != "" {
+		host = s.CanonicalHost
+	}
+	return s.scheme(r) + "://" + host + s.Prefix
+}
+
+func (s *Server) openSearchHandler(w http.ResponseWriter, r *http.Request) {
+	base := s.baseURL(r)
+
+	var d openSearchDescription
+	// ShortName is limited to 16 characters by the spec.
+	d.ShortName = s.ShortSite + " RT"
+	if len(d.ShortName) > 16 {
+		d.ShortName = d.ShortName[:16]
+	}
+	d.Description = "Search " + s.Site
+	d.InputEncoding = "UTF-8"
+	d.Image.Width, d.Image.Height = 16, 16
+	d.Image.Type = "image/x-icon"
+	d.Image.URL = base + "/static/favicon.ico"
+	d.URL.Type = "text/html"
+	d.URL.Method = "get"
+	d.URL.Template = base + s.searchPath() + "?q={searchTerms}"
+
+	w.Header().Set("Content-Type", "application/opensearchdescription+xml")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(d); err != nil {
+		logf(r, "opensearch: %v", err)
+	}
+}
@@ -17,29 +17,120 @@ limitations under the License.
 */
 
 import (
+	"bytes"
 	"html/template"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
 )
 
 type Page struct {
 	Prefix       string
+	DisplayURL   string // Prefix and the ticket page path
+	SearchURL    string // Prefix and the search page path
+	TextURL      string // Prefix and the plain text ticket path
+	TicketDirURL string // Prefix and the ticket page's directory, for attachments
 	Site         string
 	ShortSite    string
 	GitHubPrefix string
 	SnapshotTime string
+	CanonicalURL string // empty unless a canonical host is configured
+	APIURL       string // serves the content as JSON, with Accept: application/json
+	LogoURL      string
+	CSSURL       string
+	HeaderHTML   template.HTML // trusted, from the operator
+	FooterHTML   template.HTML // trusted, from the operator
 	// Title is defined in the template... would it be simpler if it was here?
 	Content       interface{}
 	ID            string
 	ServerVersion string
 }
 
-func (p *Page) Render(w http.ResponseWriter, tmpl *template.Template) {
-	err := tmpl.ExecuteTemplate(w, "_base", p)
-	if err != nil {
-		log.Printf("Rendering error: %v", err)
-		http.Error(w, "Internal Error", 500)
+// Logf logs a rendering error for r.  The web package replaces it to tag
+// the lines with the request ID.
+var Logf = func(r *http.Request, format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+// Render executes tmpl for p and sends it with a 200 in reply to r.
+func (p *Page) Render(w http.ResponseWriter, r *http.Request, tmpl *template.Template) {
+	p.RenderStatus(w, r, tmpl, http.StatusOK)
+}
+
+// MaxBuffered is the largest page RenderStatus buffers.  Pages that fit
+// are sent with a Content-Length, and a rendering error becomes the error
+// page with a 500.  Bigger pages are streamed from the point they outgrow
+// the buffer.  0 disables buffering.
+var MaxBuffered = 1 << 20
+
+// spillWriter buffers up to max bytes, then sends code and writes
+// everything through to w.
+type spillWriter struct {
+	w       http.ResponseWriter
+	code    int
+	buf     bytes.Buffer
+	max     int
+	spilled bool
+}
+
+func (sw *spillWriter) Write(b []byte) (int, error) {
+	if !sw.spilled && sw.buf.Len()+len(b) <= sw.max {
+		return sw.buf.Write(b)
+	}
+	if !sw.spilled {
+		sw.spilled = true
+		sw.w.WriteHeader(sw.code)
+		if _, err := sw.w.Write(sw.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		sw.buf = bytes.Buffer{}
+	}
+	return sw.w.Write(b)
+}
+
+// RenderStatus executes tmpl for p and sends it with status code.  Pages
+// up to MaxBuffered are rendered into a buffer first so a template error
+// never leaves a half-written page behind; the client gets the error page
+// with a 500 instead.
+func (p *Page) RenderStatus(w http.ResponseWriter, r *http.Request, tmpl *template.Template, code int) {
+	sw := &spillWriter{w: w, code: code, max: MaxBuffered}
+	if err := p.Execute(sw, tmpl); err != nil {
+		Logf(r, "Rendering error: %v", err)
+		if !sw.spilled {
+			p.renderError(w, r)
+		}
+		return
+	}
+	if !sw.spilled {
+		w.Header().Set("Content-Length", strconv.Itoa(sw.buf.Len()))
+		w.WriteHeader(code)
+		w.Write(sw.buf.Bytes())
+	}
+}
+
+// Execute writes the page to w, for uses other than serving it.
+func (p *Page) Execute(w io.Writer, tmpl *template.Template) error {
+	return tmpl.ExecuteTemplate(w, "_base", p)
+}
+
+var errorTmpl = NewTemplate("error", nil, "web/templates/error.html")
+
+// renderError sends the error page, falling back to plain text if that
+// fails too.
+func (p *Page) renderError(w http.ResponseWriter, r *http.Request) {
+	ep := *p
+	ep.ID = "error"
+	ep.Content = nil
+	var buf bytes.Buffer
+	if err := errorTmpl.ExecuteTemplate(&buf, "_base", &ep); err != nil {
+		Logf(r, "Rendering error page: %v", err)
+		http.Error(w, "Internal Error", http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write(buf.Bytes())
 }
 
 func New(id string) *Page {
@@ -0,0 +1,79 @@
+package page
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	_ "github.com/rspier/rt-static/web/internal/testroot" // the templates are relative to the root
+)
+
+// testTemplate writes n bytes, then fails if fail is set.
+var testTemplate = template.Must(template.New("test").Parse(
+	`{{define "_base"}}{{.Content.Body}}{{if .Content.Fail}}{{call .Content.Fail}}{{end}}{{end}}`))
+
+type testContent struct {
+	Body string
+	Fail func() (string, error)
+}
+
+func failing() (string, error) { return "", errors.New("test error") }
+
+func TestRenderStatusBuffering(t *testing.T) {
+	defer func(max int) { MaxBuffered = max }(MaxBuffered)
+
+	tests := []struct {
+		name       string
+		max        int
+		fail       bool
+		wantCode   int
+		wantLength bool   // Content-Length sent
+		wantBody   string // prefix
+	}{
+		{"buffered", 100, false, http.StatusNotFound, true, "xxxx"},
+		{"buffered error", 100, true, http.StatusInternalServerError, true, "<!"},
+		{"streamed", 10, false, http.StatusNotFound, false, "xxxx"},
+		{"streamed error", 10, true, http.StatusNotFound, false, "xxxx"},
+		{"unbuffered", 0, false, http.StatusNotFound, false, "xxxx"},
+	}
+	for _, tc := range tests {
+		MaxBuffered = tc.max
+		c := testContent{Body: strings.Repeat("x", 50)}
+		if tc.fail {
+			c.Fail = failing
+		}
+		w := httptest.NewRecorder()
+		p := New("test")
+		p.Content = c
+		p.RenderStatus(w, httptest.NewRequest("GET", "/", nil), testTemplate, http.StatusNotFound)
+
+		if w.Code != tc.wantCode {
+			t.Errorf("%v: status %v, want %v", tc.name, w.Code, tc.wantCode)
+		}
+		if got := w.Header().Get("Content-Length") != ""; got != tc.wantLength {
+			t.Errorf("%v: Content-Length %q, want one %v", tc.name, w.Header().Get("Content-Length"), tc.wantLength)
+		}
+		if body := strings.TrimSpace(w.Body.String()); !strings.HasPrefix(body, tc.wantBody) {
+			t.Errorf("%v: body %.20q..., want it to start %q", tc.name, body, tc.wantBody)
+		}
+	}
+}
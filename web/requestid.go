@@ -0,0 +1,90 @@
+package web
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/rspier/rt-static/web/page"
+)
+
+// requestIDHeader carries the ID correlating a request with its log
+// lines, both from a proxy in front of us and back to the client.
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLen bounds the IDs accepted from clients.
+const maxRequestIDLen = 128
+
+type requestIDKey struct{}
+
+// withRequestID gives r a request ID, the client's X-Request-Id if it
+// sent a reasonable one or a new random UUID, and echoes it in the
+// response.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	w.Header().Set(requestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// validRequestID reports whether id is safe to log: not too long, and
+// printable ASCII without spaces, so it can't forge log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random (version 4) UUID.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "-"
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// requestID returns the ID withRequestID gave r, or "-" if it has none.
+func requestID(r *http.Request) string {
+	if id, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		return id
+	}
+	return "-"
+}
+
+func init() {
+	page.Logf = logf
+}
+
+// logf logs like log.Printf, prefixed with r's request ID.
+func logf(r *http.Request, format string, v ...interface{}) {
+	log.Printf("[%s] "+format, append([]interface{}{requestID(r)}, v...)...)
+}
@@ -0,0 +1,52 @@
+package web
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rspier/rt-static/web/page"
+)
+
+func TestRenderErrorLogsRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+
+	fail := func() (string, error) { return "", errors.New("test error") }
+	tmpl := template.Must(template.New("test").Funcs(template.FuncMap{"fail": fail}).Parse(
+		`{{define "_base"}}{{fail}}{{end}}`))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(requestIDHeader, "test-id")
+	r = withRequestID(w, r)
+	page.New("test").Render(w, r, tmpl)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status %v, want %v", w.Code, http.StatusInternalServerError)
+	}
+	if got := buf.String(); !strings.Contains(got, "[test-id] Rendering error") {
+		t.Errorf("log %q, want the request ID on the rendering error", got)
+	}
+}
@@ -0,0 +1,142 @@
+package web
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/rspier/rt-static/data"
+	_ "github.com/rspier/rt-static/web/internal/testroot" // the templates are relative to the root
+)
+
+// testTickets are the tickets of the test archive, id → status.  Ticket
+// 5 has a file but isn't in index.json or the search index.
+var testTickets = map[string]string{
+	"1": "open",
+	"2": "resolved",
+	"3": "rejected",
+	"5": "open",
+}
+
+// writeTestArchive writes the test archive to a temporary directory and
+// returns the data and index paths.  Ticket 4 is merged into 1, and
+// tickets 1, 2, 3 and 5 were migrated to GitHub issues 101, 102, 103 and
+// 105.
+func writeTestArchive(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	write := func(name string, v interface{}) {
+		b, ok := v.([]byte)
+		if !ok {
+			var err error
+			if b, err = json.Marshal(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	index, err := bleve.New(filepath.Join(dir, "index.bleve"), bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var indexJSON []interface{}
+	for _, id := range []string{"1", "2", "3", "5"} {
+		n, _ := strconv.Atoi(id)
+		status := testTickets[id]
+		subject := fmt.Sprintf("ticket %s about perl", id)
+		atts := []interface{}{map[string]interface{}{
+			"id":              id + "00",
+			"Filename":        "notes.txt",
+			"ContentType":     "text/plain",
+			"OriginalContent": "notes for ticket " + id,
+		}}
+		write(id+".json", map[string]interface{}{
+			"Id": id, "Status": status, "Subject": subject, "Queue": "perl5",
+			"Created": "2019-01-01 10:00:00",
+			"Transactions": []interface{}{map[string]interface{}{
+				"id": id + "0", "Type": "Create", "Created": "2019-01-01 10:00:00",
+				"Attachments": atts,
+			}},
+		})
+		if id == "5" {
+			continue
+		}
+		indexJSON = append(indexJSON, map[string]interface{}{
+			"Id": id, "Status": status, "Subject": subject,
+			"Transactions": []interface{}{map[string]interface{}{
+				"Id": id + "0", "Attachments": []interface{}{map[string]interface{}{"Id": id + "00"}},
+			}},
+		})
+		doc := map[string]interface{}{"id": n, "status": status, "subject": subject}
+		if err := index.Index(id, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	write("index.json", indexJSON)
+	write("merged.json", map[string]string{"4": "1"})
+	write(data.RTGitHubCSV, []byte("rt,github\n1,101\n2,102\n3,103\n5,105\n"))
+	return dir, filepath.Join(dir, "index.bleve")
+}
+
+// testServer opens the test archive for s and returns its handler.
+func testServer(t *testing.T, s *Server) http.Handler {
+	t.Helper()
+	return testServerWith(t, s, data.Options{})
+}
+
+// testServerWith is testServer with the archive opened with opts.
+func testServerWith(t *testing.T, s *Server, opts data.Options) http.Handler {
+	t.Helper()
+	dir, index := writeTestArchive(t)
+	tix, err := data.NewWithOptions(dir, index, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tix.Close() })
+	s.Tix = tix
+	if s.SnapshotTime.IsZero() {
+		s.SnapshotTime = time.Date(2020, 1, 2, 3, 4, 0, 0, time.UTC)
+	}
+	s.NoTimeout = true
+	return s.NewRouter()
+}
+
+// get requests target from h, with the headers in hdr, name → value.
+func get(h http.Handler, target string, hdr ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", target, nil)
+	for i := 0; i+1 < len(hdr); i += 2 {
+		r.Header.Set(hdr[i], hdr[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
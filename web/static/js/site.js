@@ -0,0 +1,22 @@
+// Event handlers for the pages, kept out of the HTML so the default
+// Content-Security-Policy needn't allow inline scripts.
+
+// Status checkboxes on the search page rerun the search.
+document.querySelectorAll('input[data-autosubmit]').forEach(function (el) {
+  el.addEventListener('change', function () {
+    this.form.submit();
+  });
+});
+
+// Copy links copy their target rather than following it, where the
+// clipboard is available.
+document.querySelectorAll('a[data-copy-link]').forEach(function (el) {
+  el.addEventListener('click', function (e) {
+    if (!navigator.clipboard) {
+      return;
+    }
+    e.preventDefault();
+    navigator.clipboard.writeText(this.href);
+    this.innerText = 'Copied';
+  });
+});
@@ -0,0 +1,130 @@
+package web
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// shownTransactions are the transaction types displayed for a ticket.
+var shownTransactions = map[string]bool{
+	"Correspond": true,
+	"Comment":    true,
+	"Create":     true,
+	"Status":     true,
+}
+
+// person formats an RT user record as "Name <email>", obfuscated.
+func person(u interface{}) string {
+	m, _ := u.(map[string]interface{})
+	name := obfuscateEmail(m["RealName"])
+	email := obfuscateEmail(m["EmailAddress"])
+	switch {
+	case email == "":
+		return name
+	case name == "":
+		return "<" + email + ">"
+	}
+	return name + " <" + email + ">"
+}
+
+// writeTicketText writes a ticket as readable plain text.
+func writeTicketText(w io.Writer, t map[string]interface{}) {
+	fmt.Fprintf(w, "RT #%v: %v\n", t["Id"], t["Subject"])
+	fmt.Fprintf(w, "Status: %v\n", t["Status"])
+	fmt.Fprintf(w, "Created: %v\n", t["Created"])
+	if g, _ := t["GitHubIssue"].(string); g != "" {
+		fmt.Fprintf(w, "GitHub: %v\n", g)
+	}
+
+	ts, _ := t["Transactions"].([]interface{})
+	for _, trI := range ts {
+		tr, _ := trI.(map[string]interface{})
+		typ, _ := tr["Type"].(string)
+		if !shownTransactions[typ] {
+			continue
+		}
+
+		fmt.Fprintf(w, "\n%s\n", strings.Repeat("-", 72))
+		fmt.Fprintf(w, "%v  %v  (%v)\n\n", tr["Created"], person(tr["Creator"]), typ)
+
+		if typ == "Status" {
+			fmt.Fprintf(w, "Status changed from %v to %v.\n", tr["OldValue"], tr["NewValue"])
+		}
+		as, _ := tr["Attachments"].([]interface{})
+		for _, aI := range as {
+			a, _ := aI.(map[string]interface{})
+			if filename, _ := a["Filename"].(string); filename != "" {
+				fmt.Fprintf(w, "[attachment: %s]\n", filename)
+				continue
+			}
+			if a["ContentType"] == "text/plain" {
+				body, _ := a["OriginalContent"].(string)
+				fmt.Fprintln(w, strings.TrimRight(body, "\n"))
+			}
+		}
+	}
+}
+
+// ticketTextHandler serves a ticket as plain text, for screen readers,
+// curl, and text indexing.
+func (s *Server) ticketTextHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("id")
+
+	if m, ok := s.Tix.Merged[id]; ok {
+		http.Redirect(w, r, s.ticketTextURL(m), http.StatusTemporaryRedirect)
+		return
+	}
+	if s.Tix.SearchOnly() {
+		s.searchOnlyHandler(w, r)
+		return
+	}
+	if (s.RequireIndexed && !s.Tix.IsIndexed(id)) || s.hiddenTicket(id) {
+		s.notFoundHandler(w, r)
+		return
+	}
+
+	d, err := s.Tix.GetTicket(id)
+	if isNotFound(err) {
+		s.notFoundHandler(w, r)
+		return
+	}
+	if err != nil {
+		logf(r, "GetTicket(%v): %v", id, err)
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+
+	if s.notModified(w, r) {
+		return
+	}
+	t, ok := d.(map[string]interface{})
+	if !ok {
+		logf(r, "GetTicket(%v): unexpected type %T", id, d)
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+
+	var b bytes.Buffer
+	writeTicketText(&b, t)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(b.Bytes())
+}
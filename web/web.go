@@ -19,69 +19,454 @@ limitations under the License.
 
 import (
 	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rspier/rt-static/data"
+	"github.com/rspier/rt-static/version"
 	"github.com/rspier/rt-static/web/page"
 
-	"github.com/blevesearch/bleve"
 	"github.com/gorilla/mux"
+	"golang.org/x/sync/semaphore"
 )
 
 // Server holds state for the webserver.
 type Server struct {
-	Tix           *data.Data
-	Prefix        string
-	Site          string
-	ShortSite     string // Perl5 or Perl6
-	SnapshotTime  time.Time
-	StaticDir     string
-	GitHubPrefix  string // https://github.com/org/repo
+	Tix          *data.Data
+	Prefix       string
+	Site         string
+	ShortSite    string // Perl5 or Perl6
+	SnapshotTime time.Time
+	StaticDir    string
+	GitHubPrefix string // https://github.com/org/repo
+	// GitHubPath is appended to GitHubPrefix to link to a ticket's
+	// GitHub issue, with {id} replaced by the issue number.  Defaults
+	// to defaultGitHubPath.
+	GitHubPath string
+	// DisplayPath and SearchPath are where, under Prefix, the ticket and
+	// search pages are served and linked to.  They default to RT's
+	// defaultDisplayPath and defaultSearchPath, so old RT links work.
+	// The plain text tickets, attachments and exports are served beside
+	// them; see textPath, ticketDir and exportPath.
+	DisplayPath   string
+	SearchPath    string
 	ServerVersion string
+	DefaultQuery  string // query for the landing page, empty searches (recent tickets) and "*"
+	// RequireIndexed only serves tickets listed in index.json, even if
+	// the ticket file exists.
+	RequireIndexed bool
+	ExportMaxRows  int // maximum rows in a CSV export, 0 means defaultExportMaxRows
+	// ResultFields are the stored fields shown as search result columns,
+	// in order.  Defaults to defaultResultFields.
+	ResultFields []string
+	// MaxAttachmentBytes is the largest attachment that will be served.
+	// 0 means no limit.
+	MaxAttachmentBytes int
+	// AdminToken is the bearer token required by the admin endpoints.
+	// They are disabled when it is empty.
+	AdminToken string
+	// Reload rebuilds Tix for the admin reload endpoint.  The current
+	// Tix is still open and serving while it runs, so the bleve index has
+	// to be opened read-only or be a new one; the old Tix is closed once
+	// the requests using it are done.
+	Reload func() (*data.Data, error)
+	// SearchRate limits searches and exports per second per client, with
+	// bursts of up to SearchBurst.  0 disables rate limiting.
+	SearchRate  float64
+	SearchBurst int
+	// TrustedProxies are the addresses of reverse proxies whose
+	// X-Forwarded-For and X-Real-IP headers are believed.  Those headers
+	// are ignored when it's empty.
+	TrustedProxies []*net.IPNet
+	// CanonicalHost, if set, is the only host name pages are served
+	// under.  Requests for other hosts are redirected to it.
+	CanonicalHost string
+	// Branding for the operator's site.  LogoURL is shown next to the
+	// site name and CSSURL is loaded after the site stylesheet.
+	// HeaderHTML is added to the navigation bar's links (as <li> items)
+	// and FooterHTML to the footer.  The HTML is inserted unescaped, so
+	// it must come from the operator, never from users or the archive.
+	LogoURL    string
+	CSSURL     string
+	HeaderHTML template.HTML
+	FooterHTML template.HTML
+	// Compression lists the content encodings ("br", "gzip") pages may be
+	// sent with, most preferred first.  Nothing is compressed when it's
+	// empty.  The levels are those of the packages, 0 meaning default.
+	Compression []string
+	GzipLevel   int
+	BrotliLevel int
+	// LogSample logs only one in LogSample successful requests; 0 or 1
+	// logs them all.  LogOnlyErrors logs none of them.  Errors, and
+	// requests taking LogSlow (default defaultLogSlow) or more, are
+	// always logged.
+	LogSample     int
+	LogOnlyErrors bool
+	LogSlow       time.Duration
+	// MaxAttachmentDecodes bounds how many attachments are decoded and
+	// served at once, as each is held in memory.  Others wait up to
+	// AttachmentWait (default defaultAttachmentWait) and then get a 503.
+	// 0 means no limit.
+	MaxAttachmentDecodes int
+	AttachmentWait       time.Duration
+	// HiddenStatuses are ticket statuses (e.g. "rejected") left out of
+	// searches and not served, as if the tickets didn't exist.  Nothing
+	// is hidden when it's empty.
+	HiddenStatuses map[string]bool
+	// ZipCacheDir, if set, keeps the attachments.zip built for each
+	// ticket, so it's built once per snapshot and downloads can resume.
+	// Zips from other snapshots (or loads, without SnapshotTime) are
+	// removed at startup and on reload.
+	ZipCacheDir string
+	// MaxTransactions caps the transactions shown on a ticket page, and
+	// the attachments in its list, with a link to the whole ticket
+	// (full=1).  0 means no limit.
+	MaxTransactions int
+	// CSP, ReferrerPolicy and FrameOptions are sent as the
+	// Content-Security-Policy, Referrer-Policy and X-Frame-Options
+	// headers of every response, unless they're empty.  The policy
+	// matters as pages show archived, user submitted, content; DefaultCSP
+	// suits the templates.
+	CSP            string
+	ReferrerPolicy string
+	FrameOptions   string
+	// NoTimeout serves requests without the requestTimeout limit, so
+	// handlers can be stopped in a debugger.  Not for production.
+	NoTimeout bool
+
+	// mu is held for reading while serving requests, and for writing while
+	// Tix is being replaced.
+	mu        sync.RWMutex
+	reloading sync.Mutex
+	tixUsers  *sync.WaitGroup     // detached requests using Tix, see detach
+	logCount  uint64              // requests considered by sampleLog
+	attachSem *semaphore.Weighted // nil without MaxAttachmentDecodes
+	info      *serverInfo         // cached by updateInfo
+}
+
+// requestTimeout bounds the handlers of the main router.
+const requestTimeout = 10 * time.Second
+
+// defaultGitHubPath links to GitHub issues.  "/pull/{id}" would link
+// to pull requests.
+const defaultGitHubPath = "/issues/{id}"
+
+// gitHubURL returns the link to GitHub issue n, or "" if there isn't one.
+func (s *Server) gitHubURL(n string) string {
+	if n == "" {
+		return ""
+	}
+	path := s.GitHubPath
+	if path == "" {
+		path = defaultGitHubPath
+	}
+	return s.GitHubPrefix + strings.ReplaceAll(path, "{id}", url.PathEscape(n))
+}
+
+// The RT paths of the ticket and search pages.
+const (
+	defaultDisplayPath = "/Ticket/Display.html"
+	defaultSearchPath  = "/Search/Simple.html"
+)
+
+func (s *Server) displayPath() string {
+	if s.DisplayPath == "" {
+		return defaultDisplayPath
+	}
+	return s.DisplayPath
+}
+
+func (s *Server) searchPath() string {
+	if s.SearchPath == "" {
+		return defaultSearchPath
+	}
+	return s.SearchPath
+}
+
+// ticketURL returns the path of ticket id's page.
+func (s *Server) ticketURL(id string) string {
+	return s.Prefix + s.displayPath() + "?id=" + url.QueryEscape(id)
+}
+
+// ticketTextURL returns the path of ticket id as plain text.
+func (s *Server) ticketTextURL(id string) string {
+	return s.Prefix + s.textPath() + "?id=" + url.QueryEscape(id)
+}
+
+// textPath is the path of the plain text tickets: the ticket page's,
+// with a .txt extension.
+func (s *Server) textPath() string {
+	p := s.displayPath()
+	return strings.TrimSuffix(p, path.Ext(p)) + ".txt"
+}
+
+// ticketDir is the directory of the ticket page, which attachments and
+// attachments.zip are served under.
+func (s *Server) ticketDir() string {
+	return strings.TrimSuffix(path.Dir(s.displayPath()), "/")
+}
+
+// exportPath is the path of the CSV export, beside the search page.
+func (s *Server) exportPath() string {
+	return strings.TrimSuffix(path.Dir(s.searchPath()), "/") + "/Export.csv"
+}
+
+func (s *Server) defaultQuery() string {
+	if s.DefaultQuery == "" {
+		return data.DefaultQuery
+	}
+	return s.DefaultQuery
+}
+
+// hiddenTicket reports whether ticket id has one of HiddenStatuses.
+// Tickets that aren't in index.json have no known status, so when any
+// statuses are hidden they are too.
+func (s *Server) hiddenTicket(id string) bool {
+	if len(s.HiddenStatuses) == 0 {
+		return false
+	}
+	st, ok := s.Tix.TicketStatus(id)
+	return !ok || s.HiddenStatuses[st]
+}
+
+// hiddenStatuses returns HiddenStatuses as a list, for
+// SearchOptions.ExcludeStatuses.
+func (s *Server) hiddenStatuses() []string {
+	var sts []string
+	for st, hidden := range s.HiddenStatuses {
+		if hidden {
+			sts = append(sts, st)
+		}
+	}
+	sort.Strings(sts)
+	return sts
+}
+
+// statuses returns the statuses of the tickets that are shown, sorted.
+func (s *Server) statuses() []string {
+	var sts []string
+	for _, st := range s.Tix.Statuses() {
+		if !s.HiddenStatuses[st] {
+			sts = append(sts, st)
+		}
+	}
+	return sts
+}
+
+// needTickets refuses requests for tickets and attachments when Tix is
+// search only, with searchOnlyHandler.
+func (s *Server) needTickets(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Tix.SearchOnly() {
+			s.searchOnlyHandler(w, r)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// searchOnlyHandler answers requests for tickets and attachments when
+// Tix is search only, with a 404 saying why rather than an error.
+func (s *Server) searchOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	if s.isAPI(r) {
+		writeJSONError(w, r, http.StatusNotFound, data.ErrSearchOnly.Error())
+		return
+	}
+	s.notFoundMessage(w, r, "Tickets aren't available here, this archive is search only.")
 }
 
 // NewRouter sets up the http.Handler s for our server.
 func (s *Server) NewRouter() http.Handler {
 	log.Printf("starting server with prefix %q on port", s.Prefix)
+	if s.MaxAttachmentDecodes > 0 {
+		s.attachSem = semaphore.NewWeighted(int64(s.MaxAttachmentDecodes))
+	}
+	s.tixUsers = new(sync.WaitGroup)
+	if err := s.updateInfo(); err != nil {
+		log.Printf("info: %v", err)
+	}
+	s.evictZipCache(s.zipCacheKey(s.Tix))
 	r := mux.NewRouter()
 
 	// We should use http.StripPrefix instead of prepending pr, but it
 	// wasn't working right, and requires logging changes to track the
 	// pre-StripPrefix URL.
-	r.HandleFunc("/", s.indexHandler)
-	r.HandleFunc("/index.html", s.indexHandler)
-	r.HandleFunc(s.Prefix, s.indexHandler)
+	// Other spellings of the root are redirected here by normalizeRoot.
 	r.HandleFunc(s.Prefix+"/", s.indexHandler)
-	r.HandleFunc(s.Prefix+"/index.html", s.indexHandler)
 	r.HandleFunc("/robots.txt", s.robotsTxtHandler)
-	r.HandleFunc(s.Prefix+"/Ticket/Display.html", s.ticketHandler)
-	r.HandleFunc(s.Prefix+"/Ticket/Attachment/{transactionID}/{attachmentID:[0-9]+}/{filename}", s.attachHandler)
-	r.HandleFunc(s.Prefix+"/Search/Simple.html", s.searchHandler)
+	r.HandleFunc("/healthz", s.healthzHandler)
+	r.HandleFunc(s.Prefix+"/opensearch.xml", s.openSearchHandler)
+	// These follow merges even when search only, so check SearchOnly
+	// themselves.
+	r.HandleFunc(s.Prefix+s.displayPath(), s.ticketHandler)
+	r.HandleFunc(s.Prefix+s.textPath(), s.ticketTextHandler)
+	r.HandleFunc(s.Prefix+s.ticketDir()+"/Attachment/{transactionID}/{attachmentID:[0-9]+}/{filename}", s.needTickets(s.attachHandler))
+	// Searches and exports share a rate limit.
+	limit := s.rateLimit()
+	r.HandleFunc(s.Prefix+s.searchPath(), limit(s.searchHandler))
+	r.HandleFunc(s.Prefix+"/github/{n:[0-9]+}", s.gitHubRedirectHandler)
+	r.HandleFunc(s.Prefix+"/api/ticket/{id:[0-9]+}/attachments", s.needTickets(s.apiAttachmentsHandler))
+	r.HandleFunc(s.Prefix+"/api/info", s.apiInfoHandler)
+	r.HandleFunc(s.Prefix+"/api/github/{id:[0-9]+}", s.apiGitHubHandler)
+	r.PathPrefix(s.Prefix + "/api/").HandlerFunc(s.apiNotFoundHandler) // after the other API routes
 	// route to serve static content
 	r.PathPrefix(s.Prefix + "/static").Handler(http.StripPrefix(s.Prefix+"/static", http.FileServer(http.Dir(s.StaticDir))))
 	r.HandleFunc(s.Prefix+"/rtgithub.csv", s.rtGitHubCSVHandler)
 
-	return logWrap(http.TimeoutHandler(r, 10*time.Second, "response took too long"))
+	// Exports and zips stream for longer than the timeout allows, and
+	// http.TimeoutHandler buffers responses, so route them around it.
+	top := mux.NewRouter()
+	// The reload handler takes s.mu itself, so must not be wrapped in
+	// readLock.  Exports and zips detach from it once they start streaming.
+	top.HandleFunc(s.Prefix+"/admin/reload", s.requireAdmin(s.reloadHandler)).Methods(http.MethodPost)
+	top.HandleFunc(s.Prefix+"/debug/ticket/{id:[0-9]+}", s.requireAdmin(s.needTickets(s.debugTicketHandler)))
+	top.HandleFunc(s.Prefix+s.exportPath(), limit(s.exportHandler))
+	top.HandleFunc(s.Prefix+s.ticketDir()+"/{id:[0-9]+}/attachments.zip", s.needTickets(s.attachmentsZipHandler))
+	var h http.Handler = r
+	if !s.NoTimeout {
+		h = http.TimeoutHandler(r, requestTimeout, "response took too long")
+	}
+	top.PathPrefix("/").Handler(s.compress(h))
+
+	return s.logWrap(s.recoverPanics(s.securityHeaders(s.canonicalHost(s.normalizeRoot(s.readLock(top))))))
 }
 
-func logWrap(h http.Handler) http.Handler {
+// scheme returns the scheme the client used to make the request.
+func (s *Server) scheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	addr, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if p := r.Header.Get("X-Forwarded-Proto"); p != "" && s.isTrustedProxy(addr) {
+		return p
+	}
+	return "http"
+}
+
+// canonicalHost redirects requests for any host other than CanonicalHost.
+// Requests other than GET and HEAD get a 308, which, unlike a 301,
+// doesn't let clients turn a POST into a GET.
+func (s *Server) canonicalHost(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.CanonicalHost != "" && r.Host != s.CanonicalHost {
+			code := http.StatusMovedPermanently
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				code = http.StatusPermanentRedirect
+			}
+			http.Redirect(w, r, s.scheme(r)+"://"+s.CanonicalHost+r.URL.RequestURI(), code)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// normalizeRoot redirects the other ways of asking for the site root
+// ("/", "/index.html", with and without Prefix) to Prefix+"/", so there's
+// only one URL for it.
+func (s *Server) normalizeRoot(h http.Handler) http.Handler {
+	root := s.Prefix + "/"
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/", "/index.html", s.Prefix, s.Prefix + "/index.html":
+			if r.URL.Path != root {
+				u := *r.URL
+				u.Path = root
+				http.Redirect(w, r, u.RequestURI(), http.StatusMovedPermanently)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// unlockKey is the context key for the function releasing a request's
+// read lock on s.mu.
+type unlockKey struct{}
+
+// readLock holds s.mu for reading while h runs, so that Tix isn't swapped
+// out from under it, unless h calls detach.
+func (s *Server) readLock(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == s.Prefix+"/admin/reload" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		s.mu.RLock()
+		var once sync.Once
+		unlock := func() { once.Do(s.mu.RUnlock) }
+		defer unlock()
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), unlockKey{}, unlock)))
+	})
+}
+
+// detach releases the read lock readLock holds for r, so a long running
+// response like an export doesn't hold up a reload.  From then on the
+// handler must use the returned Data rather than s.Tix, and call done when
+// it's finished with it; a reload only closes the old Data after that.
+func (s *Server) detach(r *http.Request) (tix *data.Data, done func()) {
+	tix, users := s.Tix, s.tixUsers
+	users.Add(1)
+	if unlock, ok := r.Context().Value(unlockKey{}).(func()); ok {
+		unlock()
+	}
+	return tix, users.Done
+}
+
+// defaultLogSlow is the Server.LogSlow used when it's unset.
+const defaultLogSlow = time.Second
+
+func (s *Server) logWrap(h http.Handler) http.Handler {
+	slow := s.LogSlow
+	if slow == 0 {
+		slow = defaultLogSlow
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r = withRequestID(w, r)
 		rw := &responseWriter{ResponseWriter: w}
 		h.ServeHTTP(rw, r)
-		fmt.Printf("%v %v %v %v %v\n", time.Now().Format(time.RFC3339), r.RemoteAddr, r.Method, r.RequestURI, rw.status)
+		if s.sampleLog(rw.status, time.Since(start) >= slow) {
+			fmt.Printf("%v %v %v %v %v %v\n", time.Now().Format(time.RFC3339), s.clientIP(r), r.Method, r.RequestURI, rw.status, requestID(r))
+		}
 	})
 }
 
+// sampleLog reports whether a request should be logged.  Errors and slow
+// requests always are; the rest as LogOnlyErrors and LogSample say.
+func (s *Server) sampleLog(status int, slow bool) bool {
+	if status >= 400 || slow { // 3xx are routine redirects and 304s
+		return true
+	}
+	if s.LogOnlyErrors {
+		return false
+	}
+	if s.LogSample <= 1 {
+		return true
+	}
+	return atomic.AddUint64(&s.logCount, 1)%uint64(s.LogSample) == 0
+}
+
 // responseWriter intercepts the WriteHeader call so the status can be used for logging.
 type responseWriter struct {
 	http.ResponseWriter
@@ -93,11 +478,52 @@ func (rw *responseWriter) WriteHeader(status int) {
 	rw.status = status
 }
 
-// Ticket is a struct that is used for search results
-type Ticket struct {
-	ID      string `json:"Id"`
-	Status  string
-	Subject string
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// defaultResultFields are the columns shown in search results, in order.
+var defaultResultFields = []string{"id", "subject", "status"}
+
+func (s *Server) resultFields() []string {
+	if len(s.ResultFields) == 0 {
+		return defaultResultFields
+	}
+	return s.ResultFields
+}
+
+func hasField(fields []string, f string) bool {
+	for _, x := range fields {
+		if x == f {
+			return true
+		}
+	}
+	return false
+}
+
+// maxRequestFields bounds the fields= parameter.
+const maxRequestFields = 20
+
+var fieldNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// requestFields returns the stored fields asked for with a fields=a,b
+// parameter, or nil if there wasn't one.  This lets the API and exports
+// fetch more than the HTML results show.  Invalid names are dropped.
+func requestFields(r *http.Request) []string {
+	v := r.FormValue("fields")
+	if v == "" {
+		return nil
+	}
+	fs := []string{}
+	for _, f := range strings.Split(v, ",") {
+		f = strings.TrimSpace(f)
+		if fieldNameRe.MatchString(f) && len(fs) < maxRequestFields {
+			fs = append(fs, f)
+		}
+	}
+	return fs
 }
 
 var tmpl *template.Template
@@ -114,6 +540,23 @@ func elide(input string, show int) string {
 	return input + "..."
 }
 
+// Obfuscation controls how email addresses are shown.
+type Obfuscation struct {
+	LocalChars  int // characters of the local part to show
+	DomainChars int // characters of the domain to show
+	// Hash replaces addresses with a stable hash, so the same person can
+	// be recognized across tickets without revealing the address.
+	Hash bool
+	// HashKey keys the hash, so an address can't be confirmed by hashing
+	// a guess.
+	HashKey []byte
+}
+
+// EmailObfuscation applies to every address shown.  It's package level,
+// like the template functions that use it, and should be set before
+// serving.
+var EmailObfuscation = Obfuscation{LocalChars: 4, DomainChars: 3}
+
 func obfuscateEmail(emailI interface{}) string {
 	// accept an interface{} to deal with the nil case easily.
 	// Otherwise template gets unhappy.
@@ -127,11 +570,41 @@ func obfuscateEmail(emailI interface{}) string {
 	if !strings.Contains(email, "@") {
 		return email
 	}
+	o := EmailObfuscation
+	if o.Hash {
+		h := hmac.New(sha256.New, o.HashKey)
+		h.Write([]byte(strings.ToLower(email)))
+		return hex.EncodeToString(h.Sum(nil))[:16]
+	}
 	parts := strings.SplitN(email, "@", 2)
 	if len(parts) < 2 {
 		parts = append(parts, "")
 	}
-	return elide(parts[0], 4) + "@" + elide(parts[1], 3)
+	return elide(parts[0], o.LocalChars) + "@" + elide(parts[1], o.DomainChars)
+}
+
+// obfuscateUsers returns a copy of a ticket with the names and addresses
+// of users obfuscated, as they are on the HTML pages.
+func obfuscateUsers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			if k == "EmailAddress" || k == "RealName" {
+				m[k] = obfuscateEmail(e)
+				continue
+			}
+			m[k] = obfuscateUsers(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = obfuscateUsers(e)
+		}
+		return l
+	}
+	return v
 }
 
 func statusToBadgeClass(status string) string {
@@ -151,31 +624,47 @@ func statusToBadgeClass(status string) string {
 	return "badge-light"
 }
 
-func isNotFound(err error) bool {
-	// error wrapping is better than string matching
-	if errors.Is(err, os.ErrNotExist) {
-		return true
-	}
-	if err != nil {
-		return strings.Contains(err.Error(), "no such file or directory")
+// formatDuration renders d for people, like "840 µs", "12 ms" or "1.2 s".
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Millisecond:
+		return fmt.Sprintf("%d µs", d.Microseconds())
+	case d < 10*time.Millisecond:
+		return fmt.Sprintf("%.1f ms", float64(d)/float64(time.Millisecond))
+	case d < time.Second:
+		return fmt.Sprintf("%d ms", d.Milliseconds())
+	case d < 10*time.Second:
+		return fmt.Sprintf("%.1f s", d.Seconds())
 	}
-	return false
+	return fmt.Sprintf("%d s", d.Round(time.Second)/time.Second)
+}
+
+// isNotFound reports whether err means the ticket or attachment doesn't
+// exist.  The readers wrap os.ErrNotExist, so this doesn't depend on the
+// OS's error text.
+func isNotFound(err error) bool {
+	return errors.Is(err, data.ErrTicketNotFound) || errors.Is(err, data.ErrAttachmentNotFound) ||
+		errors.Is(err, os.ErrNotExist)
 }
 
 func (s *Server) indexHandler(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, fmt.Sprintf("%s/Search/Simple.html?q=status:*", s.Prefix), http.StatusTemporaryRedirect)
+	http.Redirect(w, r, s.Prefix+s.searchPath()+"?q="+url.QueryEscape(s.defaultQuery()), http.StatusTemporaryRedirect)
 }
 
 func (s *Server) rtGitHubCSVHandler(w http.ResponseWriter, r *http.Request) {
 	fh, err := s.Tix.RTGitHubCSV()
 	if err != nil {
-		log.Printf("GetTRTGitHubCSV(): %v", err)
+		logf(r, "GetTRTGitHubCSV(): %v", err)
 		http.Error(w, "Internal Error", 500)
 		return
 	}
 	defer fh.Close()
 
-	w.Header().Add("Content-Type", "text/csv; charset=utf-8")
+	if s.Tix.RTGitHubTSV() {
+		w.Header().Add("Content-Type", "text/tab-separated-values; charset=utf-8")
+	} else {
+		w.Header().Add("Content-Type", "text/csv; charset=utf-8")
+	}
 
 	var ww io.Writer = w
 
@@ -188,55 +677,322 @@ func (s *Server) rtGitHubCSVHandler(w http.ResponseWriter, r *http.Request) {
 	// http.ServeContent would be better as it has all the bells and whistles,
 	// but requires an io.ReadSeeker, which means we need to read the file and
 	// buffer it in memory first.
-	_, err = io.Copy(ww, fh)
+	if len(s.HiddenStatuses) > 0 {
+		err = s.Tix.FilterRTGitHubCSV(ww, fh, func(id string) bool { return !s.hiddenTicket(id) })
+	} else {
+		_, err = io.Copy(ww, fh)
+	}
 	if err != nil {
-		log.Printf("Copy(w,fh): %v", err)
+		logf(r, "rtgithub.csv: %v", err)
 		http.Error(w, "Internal Error", 500)
 		return
 	}
 
 }
 
+// attachmentLink is an entry in the ticket page's attachment list.
+type attachmentLink struct {
+	data.Attachment
+	Unavailable bool // not downloadable, so not linked
+}
+
+func (s *Server) attachmentLinks(atts []data.Attachment) []attachmentLink {
+	var l []attachmentLink
+	for _, a := range atts {
+		l = append(l, attachmentLink{a, !s.Tix.HasAttachment(a.ID)})
+	}
+	return l
+}
+
+// markUnavailable sets Unavailable on the attachments in a ticket's
+// transactions that can't be downloaded, so the template doesn't link
+// to them.
+func (s *Server) markUnavailable(t map[string]interface{}) {
+	ts, _ := t["Transactions"].([]interface{})
+	for _, trI := range ts {
+		tr, _ := trI.(map[string]interface{})
+		atts, _ := tr["Attachments"].([]interface{})
+		for _, aI := range atts {
+			if att, ok := aI.(map[string]interface{}); ok && !s.Tix.HasAttachment(fmt.Sprint(att["id"])) {
+				att["Unavailable"] = true
+			}
+		}
+	}
+}
+
+// numSimilarTickets is how many related tickets are shown on a ticket page.
+const numSimilarTickets = 5
+
 var ticketTmpl = page.NewTemplate(
 	"ticket",
 	template.FuncMap{
-		"obfuscateEmail": obfuscateEmail,
+		"obfuscateEmail":     obfuscateEmail,
+		"statusToBadgeClass": statusToBadgeClass,
+		"linkTickets":        linkTickets,
 	},
 	"web/templates/ticket.html")
 
+var lookupTmpl = page.NewTemplate(
+	"lookup",
+	template.FuncMap{
+		"statusToBadgeClass": statusToBadgeClass,
+	},
+	"web/templates/lookup.html")
+
+// maxPrefixMatches caps the tickets listed for an id prefix.
+const maxPrefixMatches = 100
+
+// ticketPrefixHandler lists the tickets whose ids start with prefix, for
+// an id like "123*", so someone with part of a ticket number can pick the
+// one they want.  A single match goes straight to the ticket.
+func (s *Server) ticketPrefixHandler(w http.ResponseWriter, r *http.Request, prefix string) {
+	if prefix == "" || idRe.FindString(prefix) != prefix {
+		s.notFoundHandler(w, r)
+		return
+	}
+	found, more := s.Tix.TicketsWithPrefix(prefix, maxPrefixMatches)
+	tickets := []*data.IndexTicket{} // [] rather than null
+	for _, t := range found {
+		if !s.HiddenStatuses[t.Status] {
+			tickets = append(tickets, t)
+		}
+	}
+
+	w.Header().Add("Vary", "Accept")
+	if wantsJSON(r) {
+		type jsonTicket struct{ ID, Subject, Status string }
+		js := []jsonTicket{}
+		for _, t := range tickets {
+			js = append(js, jsonTicket{t.ID, t.Subject, t.Status})
+		}
+		writeJSON(w, r, struct {
+			Prefix  string
+			Tickets []jsonTicket
+			More    bool
+		}{prefix, js, more})
+		return
+	}
+	if len(tickets) == 1 && !more {
+		http.Redirect(w, r, s.ticketURL(tickets[0].ID), http.StatusFound)
+		return
+	}
+
+	p := s.NewPage(r, "lookup", struct {
+		Prefix  string
+		Tickets []*data.IndexTicket
+		More    bool
+	}{prefix, tickets, more})
+	p.Render(w, r, lookupTmpl)
+}
+
+// idRe matches the leading ticket number of an id parameter.
+var idRe = regexp.MustCompile(`^\d+`)
+
+// legacyTicketID finds the ticket id in query strings as written by old
+// RT links, which may separate parameters with ';' (ignored by
+// url.ParseQuery) and append junk to the id, like "id=123;results=abc".
+func legacyTicketID(rawQuery string) string {
+	for _, kv := range strings.FieldsFunc(rawQuery, func(r rune) bool { return r == '&' || r == ';' }) {
+		if !strings.HasPrefix(kv, "id=") {
+			continue
+		}
+		v, err := url.QueryUnescape(strings.TrimPrefix(kv, "id="))
+		if err != nil {
+			continue
+		}
+		if id := idRe.FindString(strings.TrimSpace(v)); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// notModified sets Last-Modified to the snapshot time and, if the client
+// already has that version, replies 304 and returns true.  The whole
+// archive shares one snapshot time, so it's valid for every page.
+func (s *Server) notModified(w http.ResponseWriter, r *http.Request) bool {
+	if s.SnapshotTime.IsZero() {
+		return false
+	}
+	mod := s.SnapshotTime.UTC().Truncate(time.Second) // HTTP dates have second resolution
+	w.Header().Set("Last-Modified", mod.Format(http.TimeFormat))
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || mod.After(since) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// gitHubRedirectHandler sends links by GitHub issue number to the RT
+// ticket migrated to that issue.  The redirect is temporary, since
+// the mapping or the hidden statuses can change on reload.
+func (s *Server) gitHubRedirectHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.Tix.RTTicket(mux.Vars(r)["n"])
+	if !ok || s.hiddenTicket(id) {
+		s.notFoundHandler(w, r)
+		return
+	}
+	http.Redirect(w, r, s.ticketURL(id), http.StatusFound)
+}
+
 func (s *Server) ticketHandler(w http.ResponseWriter, r *http.Request) {
 	id := r.FormValue("id")
 
+	if strings.HasSuffix(id, "*") {
+		if s.Tix.SearchOnly() {
+			s.searchOnlyHandler(w, r)
+			return
+		}
+		s.ticketPrefixHandler(w, r, strings.TrimSuffix(id, "*"))
+		return
+	}
+	if id == "" || idRe.FindString(id) != id {
+		if clean := legacyTicketID(r.URL.RawQuery); clean != "" {
+			http.Redirect(w, r, s.ticketURL(clean), http.StatusMovedPermanently)
+			return
+		}
+	}
+
 	if m, ok := s.Tix.Merged[id]; ok {
-		http.Redirect(w, r, fmt.Sprintf("%s/Ticket/Display.html?id=%s", s.Prefix, m), http.StatusTemporaryRedirect)
+		http.Redirect(w, r, s.ticketURL(m), http.StatusTemporaryRedirect)
+		return
+	}
+	// The ticket merged into may be served from elsewhere, say pages
+	// made by render, so the redirect above still works.
+	if s.Tix.SearchOnly() {
+		s.searchOnlyHandler(w, r)
+		return
+	}
+
+	// Vary is set first so every response says it depends on Accept,
+	// and 404s come before conditional requests, so a ticket that's gone
+	// isn't reported as unchanged.
+	w.Header().Add("Vary", "Accept")
+
+	if (s.RequireIndexed && !s.Tix.IsIndexed(id)) || s.hiddenTicket(id) {
+		s.notFoundHandler(w, r)
 		return
 	}
 
 	d, err := s.Tix.GetTicket(id)
 	if isNotFound(err) {
-		http.NotFound(w, r)
+		s.notFoundHandler(w, r)
 		return
 	}
 	if err != nil {
-		log.Printf("GetTicket(%v): %v", id, err)
+		logf(r, "GetTicket(%v): %v", id, err)
 		http.Error(w, "Internal Error", 500)
 		return
 	}
 
-	p := s.NewPage("ticket", d)
-	p.Render(w, ticketTmpl)
+	if s.notModified(w, r) {
+		return
+	}
+	if wantsJSON(r) {
+		writeJSON(w, r, obfuscateUsers(d))
+		return
+	}
+
+	s.addTicketExtras(r, id, d)
+	if r.FormValue("full") != "1" {
+		s.truncateTicket(d)
+	}
+	p := s.NewPage(r, "ticket", d)
+	p.Render(w, r, ticketTmpl)
 }
 
-func (s *Server) attachHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	attID := vars["attachmentID"]
+// shownTransaction reports whether the ticket page shows a transaction,
+// as opposed to the bookkeeping ones (e.g. "Set") it skips.
+func shownTransaction(tr interface{}) bool {
+	m, _ := tr.(map[string]interface{})
+	typ, _ := m["Type"].(string)
+	return shownTransactions[typ]
+}
 
-	filename, contentType, content, err := s.Tix.GetAttachment(attID)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
+// truncateTicket cuts the transactions shown and the attachment list of
+// d, a ticket with its extras, to MaxTransactions, and records how many
+// were left out for the template.
+func (s *Server) truncateTicket(d interface{}) {
+	t, ok := d.(map[string]interface{})
+	if !ok || s.MaxTransactions <= 0 {
 		return
 	}
+	ts, _ := t["Transactions"].([]interface{})
+	shown, omitted := 0, 0
+	for i, tr := range ts {
+		if !shownTransaction(tr) {
+			continue
+		}
+		shown++
+		if shown > s.MaxTransactions {
+			if omitted == 0 {
+				t["Transactions"] = ts[:i]
+			}
+			omitted++
+		}
+	}
+	t["OmittedTransactions"] = omitted
+	if atts, _ := t["AttachmentList"].([]attachmentLink); len(atts) > s.MaxTransactions {
+		t["AttachmentList"] = atts[:s.MaxTransactions]
+		t["OmittedAttachments"] = len(atts) - s.MaxTransactions
+	}
+}
 
+// addTicketExtras adds what the ticket page shows besides the ticket
+// itself to d, the ticket as returned by GetTicket.
+func (s *Server) addTicketExtras(r *http.Request, id string, d interface{}) {
+	similar, err := s.Tix.SimilarTickets(r.Context(), id, numSimilarTickets)
+	if err != nil {
+		logf(r, "SimilarTickets(%v): %v", id, err)
+	}
+	shown := similar[:0]
+	for _, t := range similar {
+		if !s.HiddenStatuses[t.Status] {
+			shown = append(shown, t)
+		}
+	}
+	similar = shown
+	// Like GitHubIssue, tack these on to the ticket for the template.
+	if t, ok := d.(map[string]interface{}); ok {
+		g, _ := t["GitHubIssue"].(string)
+		t["GitHubURL"] = s.gitHubURL(g)
+		t["SimilarTickets"] = similar
+		t["AttachmentList"] = s.attachmentLinks(data.TicketAttachments(d))
+		s.markUnavailable(t)
+	}
+}
+
+// ErrHidden is returned by RenderTicket for tickets that aren't served
+// because of HiddenStatuses.
+var ErrHidden = errors.New("ticket is hidden")
+
+// RenderTicket writes the HTML page for ticket id to w, as
+// ticketHandler would serve it, for a static copy of the archive.
+func (s *Server) RenderTicket(ctx context.Context, w io.Writer, id string) error {
+	if s.hiddenTicket(id) {
+		return fmt.Errorf("%v: %w", id, ErrHidden)
+	}
+	d, err := s.Tix.GetTicket(id)
+	if err != nil {
+		return err
+	}
+	// NewPage only looks at the request for the canonical URL.
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, s.ticketURL(id), nil)
+	if err != nil {
+		return err
+	}
+	s.addTicketExtras(r, id, d)
+	return s.NewPage(r, "ticket", d).Execute(w, ticketTmpl)
+}
+
+var tooLargeTmpl = page.NewTemplate("toolarge", nil, "web/templates/toolarge.html")
+
+// setAttachmentHeaders sets the headers for serving an attachment.
+func setAttachmentHeaders(w http.ResponseWriter, filename, contentType string, size int) {
 	if strings.HasSuffix(filename, ".pod") && contentType == "application/x-perl" {
 		contentType = "text/plain"
 	}
@@ -250,12 +1006,354 @@ func (s *Server) attachHandler(w http.ResponseWriter, r *http.Request) {
 			fmt.Sprintf("attachment; filename=%q", filename))
 	}
 	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+}
+
+func (s *Server) attachHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	attID := vars["attachmentID"]
+
+	if tid, ok := s.Tix.AttachmentTicket(attID); ok && s.hiddenTicket(tid) {
+		s.notFoundHandler(w, r)
+		return
+	}
+
+	att, err := s.Tix.FindAttachment(attID)
+	if isNotFound(err) {
+		s.notFoundHandler(w, r)
+		return
+	}
+	if err != nil {
+		logf(r, "FindAttachment(%v): %v", attID, err)
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+
+	if s.notModified(w, r) {
+		return
+	}
+	if s.MaxAttachmentBytes > 0 && att.Size > s.MaxAttachmentBytes {
+		p := s.NewPage(r, "toolarge", struct {
+			data.Attachment
+			Limit int
+		}{att.Attachment, s.MaxAttachmentBytes})
+		p.RenderStatus(w, r, tooLargeTmpl, http.StatusForbidden)
+		return
+	}
+	// HEAD only needs the metadata, which doesn't require decoding.
+	if r.Method == http.MethodHead {
+		setAttachmentHeaders(w, att.Filename, att.ContentType, att.Size)
+		return
+	}
+
+	release, ok := s.acquireAttachment(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	content, err := att.Content()
+	if err != nil {
+		logf(r, "attachment %v: %v", attID, err)
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+
+	setAttachmentHeaders(w, att.Filename, att.ContentType, len(content))
 	w.Write(content)
 }
 
+// defaultAttachmentWait is the Server.AttachmentWait used when it's unset.
+// It's short because a client waiting longer is better off retrying.
+const defaultAttachmentWait = 2 * time.Second
+
+// acquireAttachment waits for one of the MaxAttachmentDecodes slots.  If
+// none frees up in time it replies 503 and returns false.  Otherwise
+// release must be called once the attachment has been sent.
+func (s *Server) acquireAttachment(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	if s.attachSem == nil {
+		return func() {}, true
+	}
+	wait := s.AttachmentWait
+	if wait <= 0 {
+		wait = defaultAttachmentWait
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+	if err := s.attachSem.Acquire(ctx, 1); err != nil {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Too many attachment downloads, try again shortly", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return func() { s.attachSem.Release(1) }, true
+}
+
+func (s *Server) apiAttachmentsHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	atts, err := s.Tix.ListAttachments(id)
+	if isNotFound(err) || s.hiddenTicket(id) {
+		writeJSONError(w, r, http.StatusNotFound, "ticket not found")
+		return
+	}
+	if err != nil {
+		logf(r, "ListAttachments(%v): %v", id, err)
+		writeJSONError(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if atts == nil {
+		atts = []data.Attachment{} // [] rather than null
+	}
+	writeJSON(w, r, atts)
+}
+
+// apiGitHubHandler returns the GitHub issue a ticket was migrated to,
+// for tools rewriting links.
+func (s *Server) apiGitHubHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	g, ok := s.Tix.GitHubIssue(id)
+	if !ok || s.hiddenTicket(id) {
+		writeJSONError(w, r, http.StatusNotFound, "no GitHub issue for ticket")
+		return
+	}
+	var link string
+	if s.GitHubPrefix != "" {
+		link = s.gitHubURL(g)
+	}
+	writeJSON(w, r, struct {
+		ID          string `json:"id"`
+		GitHubIssue string `json:"github_issue"`
+		URL         string `json:"url,omitempty"`
+	}{id, g, link})
+}
+
+// wantsJSON reports whether the client asked for JSON rather than HTML.
+// Browsers always accept text/html, so they never get JSON.
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// writeJSONError replies to an API request with {"error": msg}.
+func writeJSONError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{msg})
+	if err != nil {
+		logf(r, "writeJSONError: %v", err)
+	}
+}
+
+// isAPI reports whether r is for one of the JSON API endpoints.
+func (s *Server) isAPI(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, s.Prefix+"/api/")
+}
+
+func (s *Server) apiNotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, r, http.StatusNotFound, "no such API endpoint")
+}
+
+// recoverPanics turns a panic in h into a 500, in JSON for the API, and
+// logs it with the stack.
+func (s *Server) recoverPanics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err) // net/http drops the connection quietly
+			}
+			logf(r, "panic serving %v: %v\n%s", r.URL, err, debug.Stack())
+			// If the handler already started the response this can't
+			// replace it, but that's rare since pages are buffered.
+			if s.isAPI(r) {
+				writeJSONError(w, r, http.StatusInternalServerError, "internal error")
+				return
+			}
+			http.Error(w, "Internal Error", http.StatusInternalServerError)
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		logf(r, "writeJSON: %v", err)
+	}
+}
+
+// statusOption is a status checkbox on the search page.
+type statusOption struct {
+	Name    string
+	Checked bool
+}
+
+// searchParams is the normalized state of a search request.
+type searchParams struct {
+	Query    string
+	Start    uint64
+	Num      uint64
+	Order    string   // "1" for descending, "0" for ascending, or "updated"
+	Statuses []string // sorted
+	Group    string   // "status" to group the results, or empty
+	Sort     string   // comma separated fields to sort by, "-field" descending; overrides Order
+}
+
+// Page sizes for searchParams.Num.
+const (
+	defaultPageSize = 25
+	maxPageSize     = 100
+)
+
+// parseSearchParams reads the search parameters from r.  Missing or
+// invalid values get defaults, and only statuses in known are kept.
+// Corrected numbers are described in the returned notes, so the user
+// knows why they got the results they did.
+func parseSearchParams(r *http.Request, known []string) (searchParams, []string) {
+	var notes []string
+	p := searchParams{Query: r.FormValue("q")}
+	if v := r.FormValue("start"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			notes = append(notes, fmt.Sprintf("Ignored start=%q, which isn't a whole number; showing the first results.", v))
+		} else {
+			p.Start = n
+		}
+	}
+	p.Num = defaultPageSize
+	if v := r.FormValue("num"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		switch {
+		case err != nil || n == 0:
+			notes = append(notes, fmt.Sprintf("Ignored num=%q, which isn't a positive whole number; showing %d per page.", v, defaultPageSize))
+		case n > maxPageSize:
+			notes = append(notes, fmt.Sprintf("Showing %d per page, the most allowed, rather than %d.", maxPageSize, n))
+			p.Num = maxPageSize
+		default:
+			p.Num = n
+		}
+	}
+
+	p.Order = r.FormValue("order")
+	switch p.Order {
+	case "0", "1", "updated":
+		break
+	default:
+		p.Order = "1" // Descending
+	}
+
+	if r.FormValue("group") == "status" {
+		p.Group = "status"
+	}
+	p.Sort = r.FormValue("sort") // checked against the index by the caller
+
+	checked := make(map[string]bool)
+	for _, st := range r.Form["status"] {
+		checked[st] = true
+	}
+	for _, st := range known { // already sorted
+		if checked[st] {
+			p.Statuses = append(p.Statuses, st)
+		}
+	}
+	return p, notes
+}
+
+// values encodes p, the same way whichever way it was written in the
+// request.
+func (p searchParams) values() url.Values {
+	v := url.Values{}
+	v.Set("q", p.Query)
+	if p.Start > 0 {
+		v.Set("start", strconv.FormatUint(p.Start, 10))
+	}
+	v.Set("num", strconv.FormatUint(p.Num, 10))
+	v.Set("order", p.Order)
+	if len(p.Statuses) > 0 {
+		v["status"] = p.Statuses
+	}
+	if p.Group != "" {
+		v.Set("group", p.Group)
+	}
+	if p.Sort != "" {
+		v.Set("sort", p.Sort)
+	}
+	return v
+}
+
+// exportValues encodes the parameters of p that choose the tickets in an
+// export and their order.
+func (p searchParams) exportValues() url.Values {
+	v := p.values()
+	v.Del("start")
+	v.Del("num")
+	v.Del("group")
+	return v
+}
+
+// ticketGroup is a section of grouped search results.
+type ticketGroup struct {
+	Status  string
+	Tickets []data.Ticket
+}
+
+// groupByStatus buckets tickets by status, keeping their order within
+// each bucket.  Groups follow the order of known, with any other
+// statuses after them.
+func groupByStatus(tickets []data.Ticket, known []string) []ticketGroup {
+	byStatus := make(map[string][]data.Ticket)
+	var others []string
+	for _, t := range tickets {
+		if _, ok := byStatus[t.Status]; !ok {
+			others = append(others, t.Status)
+		}
+		byStatus[t.Status] = append(byStatus[t.Status], t)
+	}
+	var groups []ticketGroup
+	for _, st := range known {
+		if ts, ok := byStatus[st]; ok {
+			groups = append(groups, ticketGroup{st, ts})
+			delete(byStatus, st)
+		}
+	}
+	for _, st := range others {
+		if ts, ok := byStatus[st]; ok {
+			groups = append(groups, ticketGroup{st, ts})
+		}
+	}
+	return groups
+}
+
+// pageURL returns a link to the search in r, starting at start.
+// Parameters other than the search ones are carried over as they are, so
+// any other filters survive.
+func pageURL(r *http.Request, p searchParams, start uint64) string {
+	v := url.Values{}
+	for k, vs := range r.URL.Query() {
+		v[k] = vs
+	}
+	v.Del("start") // these may not be set below
+	v.Del("group")
+	v.Del("sort")
+	p.Start = start
+	for k, vs := range p.values() {
+		v[k] = vs
+	}
+	return "?" + v.Encode()
+}
+
 var searchTmpl = page.NewTemplate(
 	"search", template.FuncMap{
 		"statusToBadgeClass": statusToBadgeClass,
+		"formatDuration":     formatDuration,
 	},
 	"web/templates/search.html")
 
@@ -263,15 +1361,26 @@ func (s *Server) searchHandler(w http.ResponseWriter, r *http.Request) {
 	var d struct {
 		Query      string
 		Error      string
-		Tickets    []Ticket
+		Warning    string // the search ran, but not quite as asked
+		Recent     bool   // no query was given, so these are the latest tickets
+		Tickets    []data.Ticket
+		Groups     []ticketGroup // d.Tickets as shown; one group unless group=status
+		Columns    []string
+		Debug      bool // show scores
+		Statuses   []statusOption
 		Start      uint64
 		End        uint64
 		PageSize   uint64
 		Total      uint64
 		Took       time.Duration
 		Next, Prev string
+		Permalink  string // absolute, normalized URL of this search
 		Sizes      []int
 		Order      string
+		Sort       string
+		Group      string
+		GroupURL   string // toggles grouping
+		ExportURL  string // the results as CSV
 		Prefix     string
 		Site       string
 	}
@@ -279,80 +1388,192 @@ func (s *Server) searchHandler(w http.ResponseWriter, r *http.Request) {
 	q := r.FormValue("q")
 	d.Query = q
 	d.Sizes = []int{10, 25, 50, 100}
+	d.Columns = s.resultFields()
+	d.Debug = r.FormValue("debug") == "1"
 	// TODO: These are available on the page object.
 	d.Prefix = s.Prefix
 	d.Site = s.Site
 
-	if d.Query == "*" {
-		d.Query = "status:*" // or we blow out the memory
+	// Like RT, searching for a ticket number goes straight to it,
+	// following merges.
+	if id := strings.TrimPrefix(strings.TrimSpace(q), "#"); id != "" && idRe.FindString(id) == id {
+		if m, ok := s.Tix.Merged[id]; ok {
+			id = m
+		}
+		if s.Tix.IsIndexed(id) {
+			http.Redirect(w, r, s.ticketURL(id), http.StatusTemporaryRedirect)
+			return
+		}
 	}
 
-	start, _ := strconv.ParseUint(r.FormValue("start"), 10, 64)  // ignore error, get 0
-	pageSize, _ := strconv.ParseUint(r.FormValue("num"), 10, 64) // ignore error, get 0
-	if pageSize == 0 {
-		pageSize = 25
-	} else if pageSize > 100 {
-		pageSize = 25
+	// Results only change with the index, which is part of the snapshot.
+	w.Header().Add("Vary", "Accept")
+	if s.notModified(w, r) {
+		return
 	}
 
-	order := r.FormValue("order")
-	switch order {
-	case "0", "1":
-		break
-	default:
-		order = "1" // Descending
+	// Bad parameters, say from odd links, are corrected rather than
+	// refused, with a note saying so.
+	params, notes := parseSearchParams(r, s.statuses())
+	opts := data.NewTicketSearch(q, params.Order, params.Statuses, s.defaultQuery())
+	opts.ExcludeStatuses = s.hiddenStatuses()
+	if opts.Query == "" {
+		// Rather than a blank page, show the latest tickets.
+		opts.Query = s.defaultQuery()
+		d.Recent = true
+	}
+	if params.Sort != "" {
+		sb, bad := s.Tix.SortBy(params.Sort)
+		if len(bad) > 0 {
+			notes = append(notes, fmt.Sprintf("Can't sort by %s. Sortable fields: %s.",
+				strings.Join(bad, ", "), strings.Join(s.Tix.SortableFields(), ", ")))
+		}
+		if sb != nil {
+			opts.SortBy = sb
+			params.Sort = strings.Join(sb, ",") // as used, for the links
+		} else {
+			notes = append(notes, "Results are in the default order.")
+			params.Sort = ""
+		}
+	}
+	d.Warning = strings.Join(notes, " ")
+	if q == "*" {
+		d.Query = opts.Query // show what was actually searched for
+	}
+	params.Query = d.Query
+	start, pageSize := params.Start, params.Num
+	d.Order = params.Order
+	d.Group = params.Group
+	d.Sort = params.Sort
+	toggled := params
+	if params.Group == "" {
+		toggled.Group = "status"
+	} else {
+		toggled.Group = ""
+	}
+	d.GroupURL = pageURL(r, toggled, params.Start)
+	d.ExportURL = s.Prefix + s.exportPath() + "?" + params.exportValues().Encode()
+	d.Permalink = s.baseURL(r) + s.searchPath() + "?" + params.values().Encode()
+
+	// Checked statuses narrow the query.  Only known statuses are offered
+	// or accepted.
+	checked := make(map[string]bool)
+	for _, st := range params.Statuses {
+		checked[st] = true
+	}
+	for _, st := range s.statuses() {
+		d.Statuses = append(d.Statuses, statusOption{st, checked[st]})
 	}
 
-	if q != "" {
+	opts.Start = int(start)
+	opts.Size = int(pageSize)
+	opts.Fields = s.resultFields()
+	if params.Group == "status" && !hasField(opts.Fields, "status") {
+		opts.Fields = append(append([]string{}, opts.Fields...), "status")
+	}
 
-		sr := bleve.NewSearchRequestOptions(bleve.NewQueryStringQuery(q), int(pageSize), int(start), false)
+	if fs := requestFields(r); fs != nil && wantsJSON(r) {
+		opts.Fields = fs
+	}
 
-		if order == "0" {
-			sr.SortBy([]string{"id"})
-		} else {
-			sr.SortBy([]string{"-id"})
+	tickets, meta, err := s.Tix.Search(r.Context(), opts)
+	if err != nil {
+		d.Error = err.Error()
+	} else {
+		for _, t := range tickets {
+			if !d.Debug {
+				t.Score = 0
+			}
+			d.Tickets = append(d.Tickets, t)
 		}
 
-		sr.Fields = []string{"id", "status", "subject"}
+		if params.Group == "status" {
+			d.Groups = groupByStatus(d.Tickets, s.Tix.Statuses())
+		} else if len(d.Tickets) > 0 {
+			d.Groups = []ticketGroup{{Tickets: d.Tickets}} // one, unnamed
+		}
 
-		searchResults, err := s.Tix.Index.SearchInContext(r.Context(), sr)
-		if err != nil {
-			d.Error = err.Error()
-		}
-
-		if searchResults != nil {
-			for _, h := range searchResults.Hits {
-				f := h.Fields
-				d.Tickets = append(d.Tickets,
-					Ticket{
-						ID:      fmt.Sprintf("%.0f", f["id"].(float64)),
-						Subject: f["subject"].(string),
-						Status:  f["status"].(string),
-					})
-			}
+		d.Total = meta.Total
+		d.Took = meta.Took
+		d.Start = start + 1
+		d.PageSize = pageSize
+		d.End = start + pageSize
+		if d.End > d.Total {
+			d.End = d.Total
+		}
 
-			d.Total = searchResults.Total
-			d.Took = searchResults.Took
-			d.Start = start + 1
-			d.PageSize = pageSize
-			d.End = start + pageSize
-			if d.End > d.Total {
-				d.End = d.Total
+		if uint64(start+pageSize) < meta.Total {
+			d.Next = pageURL(r, params, start+pageSize)
+		}
+		if start > 0 {
+			prev := uint64(0)
+			if start > pageSize {
+				prev = start - pageSize
 			}
+			d.Prev = pageURL(r, params, prev)
+		}
+	}
 
-			const params = "?q=%s&start=%d&num=%d&order=%s"
-			if uint64(start+pageSize) < searchResults.Total {
-				d.Next = fmt.Sprintf(params, url.QueryEscape(q), start+pageSize, pageSize, order)
-			}
-			prev := start - pageSize
-			if prev >= 0 && prev < 999999999 { // mixing uint and int and subtraction is hard
-				d.Prev = fmt.Sprintf(params, url.QueryEscape(q), prev, pageSize, order)
+	if wantsJSON(r) {
+		type jsonTicket struct {
+			data.Ticket
+			Fields map[string]string `json:",omitempty"` // only with fields=
+		}
+		tickets := []jsonTicket{} // [] rather than null
+		for _, t := range d.Tickets {
+			jt := jsonTicket{Ticket: t}
+			if requestFields(r) != nil {
+				jt.Fields = t.Fields
 			}
+			tickets = append(tickets, jt)
+		}
+		writeJSON(w, r, struct {
+			Query   string
+			Error   string `json:",omitempty"`
+			Warning string `json:",omitempty"`
+			Total   uint64
+			Start   uint64
+			End     uint64
+			Took    string
+			Tickets []jsonTicket
+		}{d.Query, d.Error, d.Warning, d.Total, d.Start, d.End, d.Took.String(), tickets})
+		return
+	}
+	if wantsAtom(r) {
+		if d.Error != "" {
+			http.Error(w, d.Error, http.StatusBadRequest)
+			return
+		}
+		title := s.Site + ": " + d.Query
+		if d.Recent {
+			title = s.Site + ": recent tickets"
 		}
+		s.writeAtom(w, r, title, d.Permalink, d.Tickets)
+		return
 	}
 
-	p := s.NewPage("search", d)
-	p.Render(w, searchTmpl)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	p := s.NewPage(r, "search", d)
+	p.CanonicalURL = d.Permalink
+	p.Render(w, r, searchTmpl)
+}
+
+var notFoundTmpl = page.NewTemplate("notfound", nil, "web/templates/notfound.html")
+
+func (s *Server) notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	s.notFoundMessage(w, r, "")
+}
+
+// notFoundMessage sends the not found page saying msg, or that the page
+// isn't in the archive if msg is empty.
+func (s *Server) notFoundMessage(w http.ResponseWriter, r *http.Request, msg string) {
+	p := s.NewPage(r, "notfound", msg)
+	p.RenderStatus(w, r, notFoundTmpl, http.StatusNotFound)
+}
+
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "ok %s\n", version.Get())
 }
 
 func (s *Server) robotsTxtHandler(w http.ResponseWriter, r *http.Request) {
@@ -363,16 +1584,45 @@ Disallow: /`))
 }
 
 // NewPage creates a new Page object and initializes the fields.
-func (s *Server) NewPage(id string, c interface{}) *page.Page {
+func (s *Server) NewPage(r *http.Request, id string, c interface{}) *page.Page {
 	p := page.New(id)
 	p.Site = s.Site
 	p.Prefix = s.Prefix
+	p.DisplayURL = s.Prefix + s.displayPath()
+	p.SearchURL = s.Prefix + s.searchPath()
+	p.TextURL = s.Prefix + s.textPath()
+	p.TicketDirURL = s.Prefix + s.ticketDir()
 	p.GitHubPrefix = s.GitHubPrefix
 	p.ShortSite = s.ShortSite
 	p.ServerVersion = s.ServerVersion
+	p.LogoURL = s.LogoURL
+	p.CSSURL = s.CSSURL
+	p.HeaderHTML = s.HeaderHTML
+	p.FooterHTML = s.FooterHTML
 	p.Content = c
+	if s.CanonicalHost != "" {
+		p.CanonicalURL = s.scheme(r) + "://" + s.CanonicalHost + r.URL.RequestURI()
+	}
 	if !s.SnapshotTime.IsZero() {
 		p.SnapshotTime = s.SnapshotTime.Format("Jan _2, 2006")
 	}
+	switch id {
+	case "ticket", "search":
+		p.APIURL = s.apiURL(r)
+	}
 	return p
 }
+
+// apiURL returns the absolute URL of r, which serves JSON when asked for
+// it, for the hint on pages.  It's empty for requests without a host, like
+// the ones RenderTicket makes up.
+func (s *Server) apiURL(r *http.Request) string {
+	host := r.Host
+	if s.CanonicalHost != "" {
+		host = s.CanonicalHost
+	}
+	if host == "" {
+		return ""
+	}
+	return s.scheme(r) + "://" + host + r.URL.RequestURI()
+}
@@ -0,0 +1,554 @@
+package web
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rspier/rt-static/data"
+)
+
+func TestLegacyTicketID(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"id=123", "123"},
+		{"id=123;results=abc", "123"},
+		{"results=abc;id=45", "45"},
+		{"results=abc&id=45", "45"},
+		{"id=123%3Bresults%3Dabc", "123"},
+		{"id=123abc", "123"},
+		{"id=%20123", "123"},
+		{"id=abc;id=7", "7"},
+		{"id=abc", ""},
+		{"id=", ""},
+		{"xid=12", ""},
+		{"id=%zz", ""},
+		{"", ""},
+	}
+	for _, tc := range tests {
+		if got := legacyTicketID(tc.query); got != tc.want {
+			t.Errorf("legacyTicketID(%q) = %q, want %q", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestTicketHandlerLegacyRedirect(t *testing.T) {
+	s := &Server{}
+	for _, target := range []string{
+		"/Ticket/Display.html?id=123;results=abc",
+		"/Ticket/Display.html?id=123abc",
+		"/Ticket/Display.html?results=abc;id=123",
+	} {
+		w := httptest.NewRecorder()
+		s.ticketHandler(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusMovedPermanently {
+			t.Errorf("GET %v: status %v, want %v", target, w.Code, http.StatusMovedPermanently)
+			continue
+		}
+		if got, want := w.Header().Get("Location"), s.ticketURL("123"); got != want {
+			t.Errorf("GET %v: redirected to %q, want %q", target, got, want)
+		}
+	}
+}
+
+func TestCanonicalHost(t *testing.T) {
+	s := &Server{CanonicalHost: "rt.example.org"}
+	h := s.canonicalHost(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	tests := []struct {
+		method, host string
+		want         int
+	}{
+		{"GET", "rt.example.org", http.StatusNoContent},
+		{"POST", "rt.example.org", http.StatusNoContent},
+		{"GET", "old.example.org", http.StatusMovedPermanently},
+		{"HEAD", "old.example.org", http.StatusMovedPermanently},
+		{"POST", "old.example.org", http.StatusPermanentRedirect},
+		{"PUT", "old.example.org", http.StatusPermanentRedirect},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(tc.method, "/admin/reload?x=1", nil)
+		r.Host = tc.host
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%v %v: status %v, want %v", tc.method, tc.host, w.Code, tc.want)
+		}
+		if tc.want != http.StatusNoContent {
+			if got, want := w.Header().Get("Location"), "http://rt.example.org/admin/reload?x=1"; got != want {
+				t.Errorf("%v %v: redirected to %q, want %q", tc.method, tc.host, got, want)
+			}
+		}
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{os.ErrNotExist, true},
+		{&os.PathError{Op: "open", Path: "/data/123.json", Err: syscall.ENOENT}, true},
+		// As os.Open fails on Windows: the text differs, the wrapped error doesn't.
+		{&os.PathError{Op: "open", Path: `C:\rt\out\123.json`, Err: winNotFound{}}, true},
+		{fmt.Errorf("ticket 123: %w", data.ErrTicketNotFound), true},
+		{fmt.Errorf("attachment 5: %w", data.ErrAttachmentNotFound), true},
+		// Only the wrapped error counts, not the message.
+		{errors.New("open /data/123.json: no such file or directory"), false},
+		{&os.PathError{Op: "open", Path: `C:\rt\out\123.json`, Err: os.ErrPermission}, false},
+	}
+	for _, tc := range tests {
+		if got := isNotFound(tc.err); got != tc.want {
+			t.Errorf("isNotFound(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+// winNotFound stands in for syscall.ERROR_FILE_NOT_FOUND, which only
+// exists on Windows.
+type winNotFound struct{}
+
+func (winNotFound) Error() string { return "The system cannot find the file specified." }
+
+func (winNotFound) Is(target error) bool { return target == os.ErrNotExist }
+
+func TestPageURLKeepsFilters(t *testing.T) {
+	r := httptest.NewRequest("GET", "/Search/Simple.html?q=perl&status=open&status=new&group=status&sort=-updated&queue=perl5&start=25&num=10&order=0", nil)
+	p, notes := parseSearchParams(r, []string{"new", "open", "resolved"})
+	if len(notes) > 0 {
+		t.Fatalf("parseSearchParams notes: %q", notes)
+	}
+
+	for _, start := range []uint64{0, 15, 35} {
+		link := pageURL(r, p, start)
+		u, err := url.Parse(link)
+		if err != nil {
+			t.Fatalf("pageURL returned %q: %v", link, err)
+		}
+		got := u.Query()
+		want := url.Values{
+			"q":      {"perl"},
+			"status": {"new", "open"},
+			"group":  {"status"},
+			"sort":   {"-updated"},
+			"queue":  {"perl5"},
+			"num":    {"10"},
+			"order":  {"0"},
+		}
+		if start > 0 {
+			want.Set("start", strconv.FormatUint(start, 10))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("pageURL(start=%d) = %v, want %v", start, got, want)
+		}
+
+		// Following the link gives the same search, at start.
+		next, _ := parseSearchParams(httptest.NewRequest("GET", "/Search/Simple.html"+link, nil), []string{"new", "open", "resolved"})
+		p.Start = start
+		if !reflect.DeepEqual(next, p) {
+			t.Errorf("following %q: params %+v, want %+v", link, next, p)
+		}
+	}
+}
+
+func TestConditionalRequestOrder(t *testing.T) {
+	s := &Server{}
+	h := testServer(t, s)
+	since := s.SnapshotTime.Add(time.Hour).Format(http.TimeFormat)
+
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{"/Ticket/Display.html?id=1", http.StatusNotModified},
+		{"/Ticket/Display.html?id=99", http.StatusNotFound},
+		{"/Search/Simple.html?q=perl", http.StatusNotModified},
+	}
+	for _, tc := range tests {
+		w := get(h, tc.target, "If-Modified-Since", since)
+		if w.Code != tc.want {
+			t.Errorf("GET %v: status %v, want %v", tc.target, w.Code, tc.want)
+		}
+		if got := w.Header().Values("Vary"); !hasField(got, "Accept") {
+			t.Errorf("GET %v: Vary %q, want Accept", tc.target, got)
+		}
+	}
+}
+
+func TestSearchJSONOmitsUnknownUpdated(t *testing.T) {
+	h := testServer(t, &Server{})
+	w := get(h, "/Search/Simple.html?q=perl", "Accept", "application/json")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %v, want %v", w.Code, http.StatusOK)
+	}
+	var res struct {
+		Tickets []map[string]interface{}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Tickets) == 0 {
+		t.Fatalf("no tickets in %s", w.Body)
+	}
+	// The test index has no updated field.
+	for _, tk := range res.Tickets {
+		if u, ok := tk["Updated"]; ok {
+			t.Errorf("ticket %v: Updated = %v, want it left out", tk["Id"], u)
+		}
+	}
+}
+
+func TestParseSearchParamsNumbers(t *testing.T) {
+	tests := []struct {
+		query     string
+		wantStart uint64
+		wantNum   uint64
+		wantNote  bool
+	}{
+		{"", 0, defaultPageSize, false},
+		{"start=50&num=10", 50, 10, false},
+		{"start=abc", 0, defaultPageSize, true},
+		{"start=-5", 0, defaultPageSize, true},
+		{"start=99999999999999999999999", 0, defaultPageSize, true}, // out of range
+		{"start=1.5", 0, defaultPageSize, true},
+		{"num=0", 0, defaultPageSize, true},
+		{"num=abc", 0, defaultPageSize, true},
+		{"num=-1", 0, defaultPageSize, true},
+		{"num=99999999999999999999999", 0, defaultPageSize, true},
+		{"num=1000", 0, maxPageSize, true},
+		{"start=abc&num=50", 0, 50, true},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest("GET", "/Search/Simple.html?"+tc.query, nil)
+		p, notes := parseSearchParams(r, nil)
+		if p.Start != tc.wantStart || p.Num != tc.wantNum {
+			t.Errorf("%q: start %d, num %d; want %d, %d", tc.query, p.Start, p.Num, tc.wantStart, tc.wantNum)
+		}
+		if (len(notes) > 0) != tc.wantNote {
+			t.Errorf("%q: notes %q, want a note %v", tc.query, notes, tc.wantNote)
+		}
+	}
+}
+
+func TestSearchOnly(t *testing.T) {
+	h := testServerWith(t, &Server{}, data.Options{SearchOnly: true})
+
+	tests := []struct {
+		target   string
+		want     int
+		location string
+	}{
+		{"/Ticket/Display.html?id=4", http.StatusTemporaryRedirect, "/Ticket/Display.html?id=1"},
+		{"/Ticket/Display.txt?id=4", http.StatusTemporaryRedirect, "/Ticket/Display.txt?id=1"},
+		{"/Ticket/Display.html?id=1", http.StatusNotFound, ""},
+		{"/Ticket/Display.html?id=1*", http.StatusNotFound, ""},
+		{"/Ticket/Display.txt?id=1", http.StatusNotFound, ""},
+		{"/Ticket/1/attachments.zip", http.StatusNotFound, ""},
+		{"/Search/Simple.html?q=perl", http.StatusOK, ""},
+	}
+	for _, tc := range tests {
+		w := get(h, tc.target)
+		if w.Code != tc.want {
+			t.Errorf("GET %v: status %v, want %v", tc.target, w.Code, tc.want)
+		}
+		if got := w.Header().Get("Location"); got != tc.location {
+			t.Errorf("GET %v: redirected to %q, want %q", tc.target, got, tc.location)
+		}
+		if w.Code == http.StatusNotFound {
+			if !strings.Contains(w.Body.String(), "<h2>Not Found</h2>") {
+				t.Errorf("GET %v: got %.40q..., want the not found page", tc.target, w.Body)
+			}
+			if !strings.Contains(w.Body.String(), "search only") {
+				t.Errorf("GET %v: page doesn't say the archive is search only", tc.target)
+			}
+		}
+	}
+
+	w := get(h, "/api/ticket/1/attachments")
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), `"error"`) {
+		t.Errorf("GET /api/ticket/1/attachments: %v %s, want a JSON 404", w.Code, w.Body)
+	}
+}
+
+func TestTicketText(t *testing.T) {
+	s := &Server{HiddenStatuses: map[string]bool{"rejected": true}}
+	h := testServer(t, s)
+
+	tests := []struct {
+		target   string
+		want     int
+		location string
+	}{
+		{"/Ticket/Display.txt?id=1", http.StatusOK, ""},
+		{"/Ticket/Display.txt?id=4", http.StatusTemporaryRedirect, "/Ticket/Display.txt?id=1"},
+		{"/Ticket/Display.txt?id=3", http.StatusNotFound, ""},  // hidden
+		{"/Ticket/Display.txt?id=99", http.StatusNotFound, ""}, // missing
+	}
+	for _, tc := range tests {
+		w := get(h, tc.target)
+		if w.Code != tc.want {
+			t.Errorf("GET %v: status %v, want %v", tc.target, w.Code, tc.want)
+		}
+		if got := w.Header().Get("Location"); got != tc.location {
+			t.Errorf("GET %v: redirected to %q, want %q", tc.target, got, tc.location)
+		}
+		if w.Code == http.StatusNotFound && !strings.Contains(w.Body.String(), "<h2>Not Found</h2>") {
+			t.Errorf("GET %v: got %.40q..., want the not found page", tc.target, w.Body)
+		}
+	}
+
+	if got, want := s.ticketTextURL("1&x=2"), "/Ticket/Display.txt?id=1%26x%3D2"; got != want {
+		t.Errorf("ticketTextURL(%q) = %q, want %q", "1&x=2", got, want)
+	}
+}
+
+func TestConfiguredPaths(t *testing.T) {
+	h := testServer(t, &Server{DisplayPath: "/tickets/show", SearchPath: "/search"})
+
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{"/tickets/show?id=1", http.StatusOK},
+		{"/tickets/show.txt?id=1", http.StatusOK},
+		{"/tickets/Attachment/10/100/notes.txt", http.StatusOK},
+		{"/tickets/1/attachments.zip", http.StatusOK},
+		{"/search?q=perl", http.StatusOK},
+		{"/Export.csv?q=perl", http.StatusOK},
+		{"/Ticket/Display.txt?id=1", http.StatusNotFound},
+		{"/Ticket/Attachment/10/100/notes.txt", http.StatusNotFound},
+		{"/Ticket/1/attachments.zip", http.StatusNotFound},
+		{"/Search/Export.csv?q=perl", http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		if w := get(h, tc.target); w.Code != tc.want {
+			t.Errorf("GET %v: status %v, want %v", tc.target, w.Code, tc.want)
+		}
+	}
+
+	for target, links := range map[string][]string{
+		"/tickets/show?id=1": {
+			`href="/tickets/show.txt?id=1"`,
+			`href="/tickets/1/attachments.zip"`,
+			`href="/tickets/Attachment/10/100/notes.txt"`,
+		},
+		"/search?q=perl": {`href="/Export.csv?`},
+	} {
+		body := get(h, target).Body.String()
+		for _, link := range links {
+			if !strings.Contains(body, link) {
+				t.Errorf("GET %v: no %s", target, link)
+			}
+		}
+	}
+}
+
+func TestHiddenStatuses(t *testing.T) {
+	tests := []struct {
+		target string
+		want   int // without hidden statuses, and with rejected hidden
+		hidden int
+	}{
+		{"/Ticket/Display.html?id=1", http.StatusOK, http.StatusOK},
+		{"/Ticket/Display.html?id=3", http.StatusOK, http.StatusNotFound},
+		{"/Ticket/Display.html?id=5", http.StatusOK, http.StatusNotFound}, // not indexed
+		{"/Ticket/Display.txt?id=3", http.StatusOK, http.StatusNotFound},
+		{"/Ticket/Attachment/30/300/notes.txt", http.StatusOK, http.StatusNotFound},
+		{"/Ticket/3/attachments.zip", http.StatusOK, http.StatusNotFound},
+		{"/api/github/1", http.StatusOK, http.StatusOK},
+		{"/api/github/3", http.StatusOK, http.StatusNotFound},
+		{"/api/github/5", http.StatusOK, http.StatusNotFound},
+		{"/github/101", http.StatusFound, http.StatusFound},
+		{"/github/103", http.StatusFound, http.StatusNotFound},
+		{"/github/105", http.StatusFound, http.StatusNotFound},
+	}
+	shown := testServer(t, &Server{})
+	hidden := testServer(t, &Server{HiddenStatuses: map[string]bool{"rejected": true}})
+	for _, tc := range tests {
+		if w := get(shown, tc.target); w.Code != tc.want {
+			t.Errorf("GET %v: status %v, want %v", tc.target, w.Code, tc.want)
+		}
+		if w := get(hidden, tc.target); w.Code != tc.hidden {
+			t.Errorf("GET %v, rejected hidden: status %v, want %v", tc.target, w.Code, tc.hidden)
+		}
+	}
+
+	for _, tc := range []struct {
+		h    http.Handler
+		want string
+	}{
+		{shown, "rt,github\n1,101\n2,102\n3,103\n5,105\n"},
+		{hidden, "rt,github\n1,101\n2,102\n"},
+	} {
+		w := get(tc.h, "/rtgithub.csv")
+		if w.Code != http.StatusOK || w.Body.String() != tc.want {
+			t.Errorf("GET /rtgithub.csv: %v %q, want %q", w.Code, w.Body, tc.want)
+		}
+	}
+}
+
+func TestZipCacheKey(t *testing.T) {
+	snap := time.Date(2020, 1, 2, 3, 4, 0, 0, time.UTC)
+	base := &Server{SnapshotTime: snap}
+	key := base.zipCacheKey(nil)
+	same := &Server{SnapshotTime: snap, HiddenStatuses: map[string]bool{"rejected": false}}
+	if got := same.zipCacheKey(nil); got != key {
+		t.Errorf("zipCacheKey with nothing hidden = %v, want %v", got, key)
+	}
+	for name, s := range map[string]*Server{
+		"snapshot":      {SnapshotTime: snap.Add(time.Hour)},
+		"maxattachment": {SnapshotTime: snap, MaxAttachmentBytes: 1000},
+		"hidestatuses":  {SnapshotTime: snap, HiddenStatuses: map[string]bool{"rejected": true}},
+	} {
+		if got := s.zipCacheKey(nil); got == key {
+			t.Errorf("zipCacheKey with a different %v = %v, the same as the default", name, got)
+		}
+	}
+}
+
+// inlineHandler matches event handler attributes, which DefaultCSP
+// doesn't allow.
+var inlineHandler = regexp.MustCompile(`(?i)\son[a-z]+\s*=`)
+
+func TestNoInlineScripts(t *testing.T) {
+	for _, dir := range strings.Split(DefaultCSP, ";") {
+		if f := strings.Fields(dir); len(f) > 0 && f[0] == "script-src" && strings.Contains(dir, "'unsafe-inline'") {
+			t.Errorf("DefaultCSP allows inline scripts: %v", dir)
+		}
+	}
+	tmpls, err := filepath.Glob("web/templates/*.html")
+	if err != nil || len(tmpls) == 0 {
+		t.Fatalf("no templates found: %v", err)
+	}
+	for _, fn := range tmpls {
+		b, err := os.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loc := inlineHandler.FindIndex(b); loc != nil {
+			t.Errorf("%v has an inline event handler: %q", fn, b[loc[0]:loc[1]])
+		}
+		if strings.Contains(string(b), "<script>") {
+			t.Errorf("%v has an inline script", fn)
+		}
+	}
+}
+
+func TestObfuscationFlags(t *testing.T) {
+	defer func(o Obfuscation) { EmailObfuscation = o }(EmailObfuscation)
+	key := filepath.Join(t.TempDir(), "key")
+	empty := filepath.Join(t.TempDir(), "empty")
+	os.WriteFile(key, []byte("secret\n"), 0600)
+	os.WriteFile(empty, []byte("\n"), 0600)
+
+	tests := []struct {
+		args    []string
+		want    Obfuscation
+		wantErr bool
+	}{
+		{nil, Obfuscation{LocalChars: 4, DomainChars: 3}, false},
+		{[]string{"-elidelocal=2", "-elidedomain=0"}, Obfuscation{LocalChars: 2}, false},
+		{[]string{"-obfuscate=hash", "-hashkeyfile", key}, Obfuscation{LocalChars: 4, DomainChars: 3, Hash: true, HashKey: []byte("secret")}, false},
+		{[]string{"-obfuscate=hash"}, Obfuscation{}, true},
+		{[]string{"-obfuscate=hash", "-hashkeyfile", empty}, Obfuscation{}, true},
+		{[]string{"-obfuscate=rot13"}, Obfuscation{}, true},
+	}
+	for _, tc := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		set := ObfuscationFlags(fs)
+		if err := fs.Parse(tc.args); err != nil {
+			t.Fatal(err)
+		}
+		EmailObfuscation = Obfuscation{}
+		err := set()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%q: error %v, want one %v", tc.args, err, tc.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(EmailObfuscation, tc.want) {
+			t.Errorf("%q: EmailObfuscation %+v, want %+v", tc.args, EmailObfuscation, tc.want)
+		}
+	}
+}
+
+func TestExportFilters(t *testing.T) {
+	h := testServer(t, &Server{})
+	tests := []struct {
+		query string
+		want  string // ids, in order
+	}{
+		{"q=perl", "3,2,1"},
+		{"q=perl&order=0", "1,2,3"},
+		{"q=perl&order=updated", "3,2,1"},
+		{"q=perl&status=open", "1"},
+		{"q=perl&status=open&status=rejected&order=0", "1,3"},
+		{"q=*&status=resolved", "2"},
+	}
+	for _, tc := range tests {
+		w := get(h, "/Search/Export.csv?"+tc.query)
+		if w.Code != http.StatusOK {
+			t.Errorf("export %v: status %v", tc.query, w.Code)
+			continue
+		}
+		var ids []string
+		for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n")[1:] {
+			ids = append(ids, strings.SplitN(line, ",", 2)[0])
+		}
+		if got := strings.Join(ids, ","); got != tc.want {
+			t.Errorf("export %v: ids %v, want %v", tc.query, got, tc.want)
+		}
+	}
+
+	// The search page links to the same export.
+	w := get(h, "/Search/Simple.html?q=perl&status=open&order=0&start=1&num=10")
+	if want := `href="/Search/Export.csv?order=0&amp;q=perl&amp;status=open"`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("search page doesn't link to the export with its filters, %v", want)
+	}
+}
+
+func TestExportRateLimit(t *testing.T) {
+	h := testServer(t, &Server{SearchRate: 0.001, SearchBurst: 2})
+	// Searches and exports draw on the same allowance.
+	for i, target := range []string{"/Search/Simple.html?q=perl", "/Search/Export.csv?q=perl", "/Search/Export.csv?q=perl"} {
+		want := http.StatusOK
+		if i == 2 {
+			want = http.StatusTooManyRequests
+		}
+		if w := get(h, target); w.Code != want {
+			t.Errorf("request %d, %v: status %v, want %v", i, target, w.Code, want)
+		}
+	}
+}